@@ -20,10 +20,19 @@ images that should be built.`,
 		if err != nil {
 			return err
 		}
-		return dockergen.Build(executor, builds, params, cmd.OutOrStdout())
+		out, err := configureOutput(cmd, &params)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := runContext()
+		defer cancel()
+		return dockergen.BuildContext(ctx, executor, builds, params, out)
 	},
 }
 
 func init() {
+	buildCmd.Flags().StringVar(&manifestOut, "manifest-out", "", "if specified, writes a JSON manifest of the built images (including image IDs and digests) to this path")
+	buildCmd.Flags().StringVar(&stateFile, "state-file", "", "if specified, enables incremental builds: images whose inputs are unchanged since the build recorded in this file are tagged rather than rebuilt")
+	addOutputFlag(buildCmd)
 	RootCmd.AddCommand(buildCmd)
 }
@@ -5,10 +5,16 @@
 package cmd
 
 import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
 	"sort"
+	"syscall"
 
 	"github.com/nmiyake/dockergen/dockergen"
 	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
 )
 
 // getCommonParams returns the parameters for the action based on the specified image names. If the names are empty, all
@@ -23,6 +29,9 @@ func getCommonParams(imageNames []string) (map[string]dockergen.Executor, []dock
 	}
 
 	executor := dockergen.NewCmdExecutor()
+	if dockerSocket != "" {
+		executor = dockergen.NewEngineExecutor(dockerSocket)
+	}
 	if dryRun {
 		executor = dockergen.NewPrintCmdExecutor()
 	}
@@ -79,5 +88,83 @@ func getCommonParams(imageNames []string) (map[string]dockergen.Executor, []dock
 			}
 		}
 	}
-	return allExecutorsMap, dockergen.TopologicalSort(imagesToBuild), cfg.ToParams(), nil
+	params := cfg.ToParams()
+	for _, curr := range whereVars {
+		k, v, err := parseKeyValue("where", curr)
+		if err != nil {
+			return nil, nil, dockergen.Params{}, err
+		}
+		if params.Where == nil {
+			params.Where = make(map[string][]string)
+		}
+		params.Where[k] = append(params.Where[k], v)
+	}
+	if noDeps {
+		// iterations that are only run because iterations selected by --where depend on them are not run
+		params.DependencyExecutor = dockergen.NoopExecutor()
+	}
+	params.Parallelism = parallelism
+	params.ManifestPath = manifestOut
+	params.KeepGoing = keepGoing
+	// retry flags override the configuration only if they are specified
+	if RootCmd.PersistentFlags().Changed("retries") {
+		params.Retry.Retries = &retries
+	}
+	params.Retry.RetryBackoff = retryBackoff
+	if RootCmd.PersistentFlags().Changed("retry-build") {
+		params.Retry.RetryBuild = &retryBuild
+	}
+	if !dryRun {
+		// a dry run does not build images, so it must not record them in the state file
+		params.StateFile = stateFile
+	}
+	return allExecutorsMap, dockergen.TopologicalSort(imagesToBuild), params, nil
+}
+
+// runContext returns the context for running an action. The context is canceled when the process receives an interrupt
+// or termination signal or when the duration specified by the timeout flag elapses, which stops the running docker
+// commands. The returned function must be called to release the resources associated with the context.
+func runContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.Background(), context.CancelFunc(nil)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+func addOutputFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&outputFormat, "output", outputText, `output format: "text" prints the output of docker, "json" prints a JSON event for the start and end of every build iteration (one per line) and prints the output of docker to stderr`)
+}
+
+// configureOutput configures the provided params for the format specified by the output flag and returns the writer to
+// which the output of the action should be written.
+func configureOutput(cmd *cobra.Command, params *dockergen.Params) (io.Writer, error) {
+	switch outputFormat {
+	case outputText:
+		return cmd.OutOrStdout(), nil
+	case outputJSON:
+		params.Listener = dockergen.NewJSONListener(cmd.OutOrStdout())
+		return cmd.ErrOrStderr(), nil
+	default:
+		return nil, errors.Errorf("invalid output format %q: must be %q or %q", outputFormat, outputText, outputJSON)
+	}
 }
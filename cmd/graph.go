@@ -0,0 +1,55 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package cmd
+
+import (
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	graphFormat string
+	graphExpand bool
+)
+
+var graphCmd = &cobra.Command{
+	Use:   "graph",
+	Short: "Prints the dependency graph of the builds specified in the configuration",
+	Long: `Prints the dependency graph of the images in the DOT, Mermaid or JSON format. By
+default, the graph contains a node for every build and an edge from every build to the
+builds that require it. If --expand is specified, the graph contains a node for every
+iteration of every build and an edge from every iteration to the iterations whose templates
+reference its tag using the "Tag" or "TagFor" template functions. If no arguments are
+provided, the graph contains all of the images in the configuration. If arguments are
+provided, they specify the names of the images that should be in the graph (the images
+that they require are also included).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, builds, params, err := getCommonParams(args)
+		if err != nil {
+			return err
+		}
+		graph, err := dockergen.BuildGraph(builds, params, graphExpand)
+		if err != nil {
+			return err
+		}
+		switch graphFormat {
+		case "dot":
+			return graph.WriteDOT(cmd.OutOrStdout())
+		case "mermaid":
+			return graph.WriteMermaid(cmd.OutOrStdout())
+		case "json":
+			return graph.WriteJSON(cmd.OutOrStdout())
+		default:
+			return errors.Errorf(`invalid format %q: must be "dot", "mermaid" or "json"`, graphFormat)
+		}
+	},
+}
+
+func init() {
+	graphCmd.Flags().StringVar(&graphFormat, "format", "dot", `format of the graph: "dot", "mermaid" or "json"`)
+	graphCmd.Flags().BoolVar(&graphExpand, "expand", false, "if true, the graph contains a node for every iteration of every build rather than for every build")
+	RootCmd.AddCommand(graphCmd)
+}
@@ -20,10 +20,18 @@ the images whose tags should be pushed.`,
 		if err != nil {
 			return err
 		}
-		return dockergen.Push(executor, builds, params, cmd.OutOrStdout())
+		out, err := configureOutput(cmd, &params)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := runContext()
+		defer cancel()
+		return dockergen.PushContext(ctx, executor, builds, params, out)
 	},
 }
 
 func init() {
+	pushCmd.Flags().StringVar(&manifestOut, "manifest-out", "", "if specified, writes a JSON manifest of the pushed images (including image IDs and digests) to this path")
+	addOutputFlag(pushCmd)
 	RootCmd.AddCommand(pushCmd)
 }
@@ -0,0 +1,43 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package cmd
+
+import (
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var renderOutDir string
+
+var renderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Renders the Dockerfiles specified in the configuration to disk",
+	Long: `Renders the Dockerfiles for the images to the directory specified by --out-dir without
+invoking Docker. The Dockerfile for each image is written to "<build name>/<iteration>/Dockerfile"
+within the output directory, where the iteration is the values of the "for" variables of the
+image in the form "key=value" joined with ",", along with the rendered .dockerignore and the
+files specified by "render-files". If no arguments are provided, the Dockerfiles for all of the
+images in the configuration are rendered. If arguments are provided, they specify the names
+of the images whose Dockerfiles should be rendered (the Dockerfiles of the images that they
+require are also rendered).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if renderOutDir == "" {
+			return errors.Errorf("out-dir flag is required")
+		}
+		_, builds, params, err := getCommonParams(args)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := runContext()
+		defer cancel()
+		return dockergen.RenderContext(ctx, builds, params, renderOutDir, cmd.OutOrStdout())
+	},
+}
+
+func init() {
+	renderCmd.Flags().StringVar(&renderOutDir, "out-dir", "", "directory to which rendered Dockerfiles are written")
+	RootCmd.AddCommand(renderCmd)
+}
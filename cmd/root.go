@@ -6,20 +6,35 @@ package cmd
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/nmiyake/dockergen/dockergen"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
-	"gopkg.in/yaml.v2"
 )
 
 var (
-	cfgFile string
-	dryRun  bool
-	noDeps  bool
-	cfg     dockergen.Config
+	cfgFile      string
+	dryRun       bool
+	noDeps       bool
+	parallelism  int
+	dockerSocket string
+	manifestOut  string
+	stateFile    string
+	timeout      time.Duration
+	outputFormat string
+	keepGoing    bool
+	retries      int
+	retryBackoff time.Duration
+	retryBuild   bool
+	profile      string
+	setVars      []string
+	varFiles     []string
+	forVars      []string
+	whereVars    []string
+	cfg          dockergen.Config
 )
 
 // RootCmd represents the base command when called without any subcommands
@@ -48,16 +63,78 @@ func init() {
 		if cfgFile == "" {
 			return errors.Errorf("config flag is required")
 		}
-		cfgBytes, err := ioutil.ReadFile(cfgFile)
+		loadedCfg, err := dockergen.LoadConfig(cfgFile)
 		if err != nil {
-			return errors.Wrapf(err, "failed to read config file")
+			return err
 		}
-		if err := yaml.Unmarshal(cfgBytes, &cfg); err != nil {
-			return errors.Wrapf(err, "failed to unmarshal configuration")
+		if profile != "" {
+			if loadedCfg, err = loadedCfg.WithProfile(profile); err != nil {
+				return err
+			}
 		}
+		overrides, err := varOverrides()
+		if err != nil {
+			return err
+		}
+		if loadedCfg, err = loadedCfg.WithVarOverrides(overrides); err != nil {
+			return err
+		}
+		cfg = loadedCfg
 		return nil
 	}
 
+	RootCmd.PersistentFlags().StringVar(&profile, "profile", "", "name of the profile in the configuration whose overrides are applied")
+	RootCmd.PersistentFlags().StringArrayVar(&setVars, "set", nil, "template variable to set in the form key=value (can be specified multiple times; takes precedence over --var-file and the configuration)")
+	RootCmd.PersistentFlags().StringArrayVar(&varFiles, "var-file", nil, "YAML file that maps template variable names to values (can be specified multiple times; later files take precedence and all take precedence over the configuration)")
+	RootCmd.PersistentFlags().StringArrayVar(&forVars, "for", nil, "narrows a 'for' or 'matrix' variable to the provided comma-separated values in the form key=value1,value2 (can be specified multiple times)")
+	RootCmd.PersistentFlags().StringArrayVar(&whereVars, "where", nil, "runs only the build iterations in which a 'for' or 'matrix' variable matches a glob pattern, in the form key=pattern, along with the iterations they depend on (can be specified multiple times; an iteration must match every variable and any pattern of a variable)")
 	RootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "print commands that would be run without running them")
 	RootCmd.PersistentFlags().BoolVar(&noDeps, "no-deps", false, "runs task only for the specified images (do not add dependencies)")
+	RootCmd.PersistentFlags().StringVar(&dockerSocket, "docker-socket", "", fmt.Sprintf("if specified, use the Docker Engine API served on this Unix socket (typically %s) rather than the docker CLI", dockergen.DefaultDockerSocket))
+	RootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "if greater than 0, the maximum amount of time for which the command runs before running docker commands are stopped")
+	RootCmd.PersistentFlags().BoolVar(&keepGoing, "keep-going", false, "after a build fails, continue running the builds that do not depend on it and print a summary of all builds at the end (exits with an error if any build failed)")
+	RootCmd.PersistentFlags().IntVar(&retries, "retries", 0, "number of times a push that fails with a retryable error is retried (overrides the configuration)")
+	RootCmd.PersistentFlags().DurationVar(&retryBackoff, "retry-backoff", 0, "delay before the first retry, which doubles after every retry (overrides the configuration)")
+	RootCmd.PersistentFlags().BoolVar(&retryBuild, "retry-build", false, "if true, builds that fail with a retryable error are also retried (overrides the configuration)")
+	RootCmd.PersistentFlags().IntVar(&parallelism, "parallelism", 1, "maximum number of builds to run concurrently (builds run concurrently only if they do not depend on each other)")
+}
+
+// varOverrides returns the variable overrides specified by the --set, --var-file and --for flags.
+func varOverrides() (dockergen.VarOverrides, error) {
+	overrides := dockergen.VarOverrides{
+		VarFiles: varFiles,
+	}
+	for _, curr := range setVars {
+		k, v, err := parseKeyValue("set", curr)
+		if err != nil {
+			return dockergen.VarOverrides{}, err
+		}
+		if overrides.Set == nil {
+			overrides.Set = make(map[string]string)
+		}
+		overrides.Set[k] = v
+	}
+	for _, curr := range forVars {
+		k, v, err := parseKeyValue("for", curr)
+		if err != nil {
+			return dockergen.VarOverrides{}, err
+		}
+		if _, ok := overrides.For[k]; ok {
+			return dockergen.VarOverrides{}, errors.Errorf("--for specified more than once for variable %s", k)
+		}
+		if overrides.For == nil {
+			overrides.For = make(map[string][]string)
+		}
+		overrides.For[k] = strings.Split(v, ",")
+	}
+	return overrides, nil
+}
+
+// parseKeyValue parses a value of the flag with the provided name of the form "key=value".
+func parseKeyValue(flagName, in string) (string, string, error) {
+	parts := strings.SplitN(in, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", errors.Errorf("invalid value %q for --%s: must be of the form key=value", in, flagName)
+	}
+	return parts[0], parts[1], nil
 }
@@ -20,10 +20,17 @@ specify the names of the images for which tags are printed.`,
 		if err != nil {
 			return err
 		}
-		return dockergen.Tags(executor, builds, params, cmd.OutOrStdout())
+		out, err := configureOutput(cmd, &params)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := runContext()
+		defer cancel()
+		return dockergen.TagsContext(ctx, executor, builds, params, out)
 	},
 }
 
 func init() {
+	addOutputFlag(tagsCmd)
 	RootCmd.AddCommand(tagsCmd)
 }
@@ -0,0 +1,61 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Checks the configuration without running docker",
+	Long: `Checks the configuration file and the templates that it references without running any
+docker commands. Reports unknown configuration keys, invalid "for" and "matrix" blocks,
+missing template files, templates that fail to parse or reference undefined variables,
+uses of the "Tag" and "TagFor" template functions for builds that are not declared in
+"requires" or with indexes that are out of range and rendered tags that are not valid
+Docker image references. All of the problems are reported along with the line of the
+configuration file on which they occur. The profile specified by --profile and the
+overrides specified by --set, --var-file and --for are applied before the templates
+are rendered.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// problems in the configuration file are reported by the command itself so that all of them are reported at once
+		if err := RootCmd.PersistentPreRunE(cmd, args); err != nil {
+			if _, ok := err.(*dockergen.ConfigError); !ok {
+				return err
+			}
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		overrides, err := varOverrides()
+		if err != nil {
+			return err
+		}
+		verrs, err := dockergen.ValidateConfigWithOverrides(cfgFile, profile, overrides)
+		if err != nil {
+			return err
+		}
+		if len(verrs) != 0 {
+			_, _ = fmt.Fprintln(cmd.OutOrStdout(), (&dockergen.ConfigError{Path: cfgFile, Errors: verrs}).Error())
+		}
+		switch len(verrs) {
+		case 0:
+			return nil
+		case 1:
+			return errors.Errorf("configuration has 1 error")
+		default:
+			return errors.Errorf("configuration has %d errors", len(verrs))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(validateCmd)
+}
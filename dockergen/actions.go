@@ -6,12 +6,14 @@ package dockergen
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"sort"
+	"strings"
+	"sync"
 	"text/template"
 
 	"github.com/pkg/errors"
@@ -23,20 +25,107 @@ const (
 )
 
 func Build(executors map[string]Executor, builds []BuildParams, dockerGenParams Params, stdout io.Writer) error {
-	return runActionLogic(runBuildAction, executors, builds, dockerGenParams, stdout)
+	return BuildContext(context.Background(), executors, builds, dockerGenParams, stdout)
+}
+
+// BuildContext is like Build, but stops running commands and does not start new builds when the provided context is
+// done.
+func BuildContext(ctx context.Context, executors map[string]Executor, builds []BuildParams, dockerGenParams Params, stdout io.Writer) error {
+	return runActionLogic(ctx, "build", runBuildAction, nil, executors, builds, dockerGenParams, stdout)
 }
 
 func Push(executors map[string]Executor, builds []BuildParams, dockerGenParams Params, stdout io.Writer) error {
-	return runActionLogic(runPushAction, executors, builds, dockerGenParams, stdout)
+	return PushContext(context.Background(), executors, builds, dockerGenParams, stdout)
+}
+
+// PushContext is like Push, but stops running commands and does not start new pushes when the provided context is done.
+func PushContext(ctx context.Context, executors map[string]Executor, builds []BuildParams, dockerGenParams Params, stdout io.Writer) error {
+	return runActionLogic(ctx, "push", runPushAction, nil, executors, builds, dockerGenParams, stdout)
 }
 
 func Tags(executors map[string]Executor, builds []BuildParams, dockerGenParams Params, stdout io.Writer) error {
-	return runActionLogic(runTagAction, executors, builds, dockerGenParams, stdout)
+	return TagsContext(context.Background(), executors, builds, dockerGenParams, stdout)
+}
+
+// TagsContext is like Tags, but stops when the provided context is done.
+func TagsContext(ctx context.Context, executors map[string]Executor, builds []BuildParams, dockerGenParams Params, stdout io.Writer) error {
+	return runActionLogic(ctx, "tags", runTagAction, nil, executors, builds, dockerGenParams, stdout)
+}
+
+// Render renders the Dockerfile for every build and iteration and writes it to a file named "Dockerfile" in the
+// directory "<build name>/<iteration>" within the provided output directory, where the iteration is the values of the
+// "for" variables of the iteration (see renderDirName). Returns an error if the outputs of multiple iterations would be
+// written to the same directory. Docker is not invoked.
+func Render(builds []BuildParams, dockerGenParams Params, outDir string, stdout io.Writer) error {
+	return RenderContext(context.Background(), builds, dockerGenParams, outDir, stdout)
+}
+
+// RenderContext is like Render, but stops when the provided context is done.
+func RenderContext(ctx context.Context, builds []BuildParams, dockerGenParams Params, outDir string, stdout io.Writer) error {
+	return runActionLogic(ctx, "render", func(params runParams) error {
+		return runRenderAction(params, outDir)
+	}, checkRenderDirs, nil, builds, dockerGenParams, stdout)
+}
+
+// runActionLogic plans the units for the provided builds and runs the provided action for them. If checkUnits is
+// non-nil, it is called with the units that will be run before any of them are run.
+func runActionLogic(ctx context.Context, actionName string, action runActionFunc, checkUnits func([]buildUnit) error, executors map[string]Executor, builds []BuildParams, dockerGenParams Params, stdout io.Writer) error {
+	units, tags, err := planRun(builds, dockerGenParams)
+	if err != nil {
+		return err
+	}
+	// the tags of all of the units are planned before the units are filtered so that the templates of the units that
+	// are run render the same tags as they would in an unfiltered run
+	if units, err = selectUnits(units, tags, dockerGenParams.Where); err != nil {
+		return err
+	}
+	if checkUnits != nil {
+		if err := checkUnits(units); err != nil {
+			return err
+		}
+	}
+
+	state := &runState{
+		ctx:                ctx,
+		actionName:         actionName,
+		listener:           dockerGenParams.Listener,
+		keepGoing:          dockerGenParams.KeepGoing,
+		retry:              dockerGenParams.Retry,
+		executors:          executors,
+		dependencyExecutor: dockerGenParams.DependencyExecutor,
+		tags:               tags,
+	}
+	if dockerGenParams.ManifestPath != "" {
+		state.manifest = &manifestRecorder{}
+	}
+	deps := unitDependencies(units, tags)
+	if dockerGenParams.StateFile != "" {
+		if state.incremental, err = newIncrementalState(dockerGenParams.StateFile, units, deps); err != nil {
+			return err
+		}
+	}
+	runErr := runUnits(action, units, deps, state, dockerGenParams.Parallelism, stdout)
+	if state.incremental != nil {
+		// write the state even if the run failed so that the builds that were completed are not run again
+		if err := state.incremental.writeFile(); err != nil && runErr == nil {
+			return err
+		}
+	}
+	if state.manifest != nil {
+		// write the manifest even if the run failed so that it records the images that were completed
+		if err := state.manifest.manifest().WriteFile(dockerGenParams.ManifestPath); err != nil && runErr == nil {
+			return err
+		}
+	}
+	return runErr
 }
 
-func runActionLogic(action runActionFunc, executors map[string]Executor, builds []BuildParams, dockerGenParams Params, stdout io.Writer) error {
+// planRun validates the provided params, evaluates the template variables and renders the tags for all of the provided
+// builds. Returns the units that should be run in the order in which they would be run sequentially and the store that
+// contains the rendered tags.
+func planRun(builds []BuildParams, dockerGenParams Params) ([]buildUnit, *tagStore, error) {
 	if err := dockerGenParams.Validate(); err != nil {
-		return errors.Wrapf(err, "invalid Docker generator params")
+		return nil, nil, errors.Wrapf(err, "invalid Docker generator params")
 	}
 
 	// evaluate the build variable
@@ -52,51 +141,186 @@ func runActionLogic(action runActionFunc, executors map[string]Executor, builds
 		tagSuffixTmpl = dockerGenParams.TagSuffix
 	}
 
+	partials, err := loadPartials(dockerGenParams.Partials)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	evaluatedVarMap := make(map[string]string)
 	for k, v := range dockerGenParams.TemplateVars {
-		valResult, err := executeGoTemplate(v, buildID, nil, nil, -1, -1)
+		valResult, err := executeGoTemplate(v, dockerGenParams.Dir, buildID, partials, nil, nil, -1, -1)
 		if err != nil {
-			return errors.Wrapf(err, "failed to execute template for variable %s", k)
+			return nil, nil, errors.Wrapf(err, "failed to execute template for variable %s", k)
 		}
 		evaluatedVarMap[k] = valResult
 	}
 
-	tags := make(map[string][][]string)
-	return runInFor(func(idx int, curEvalVarMap map[string]string) error {
+	tags := newTagStore()
+	units, err := planUnits(builds, dockerGenParams.Dir, buildID, tagSuffixTmpl, partials, newLoop(dockerGenParams.For, dockerGenParams.Matrix), evaluatedVarMap, tags)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkDuplicateTags(units); err != nil {
+		return nil, nil, err
+	}
+	return units, tags, nil
+}
+
+// checkDuplicateTags returns an error if multiple of the provided units use the same tag or alias. Such units would
+// overwrite each other's images, and the image that is pushed for the tag would depend on the order in which they run.
+func checkDuplicateTags(units []buildUnit) error {
+	tagUnits := make(map[string]buildUnit)
+	for _, unit := range units {
+		for _, tag := range append([]string{unit.tag}, unit.additionalTags...) {
+			if other, ok := tagUnits[tag]; ok {
+				return &planError{
+					build: unit.build.Name,
+					error: errors.Errorf("tag %s is used by both %s and %s", tag, stateKey(other.build.Name, other.iterVars), stateKey(unit.build.Name, unit.iterVars)),
+				}
+			}
+			tagUnits[tag] = unit
+		}
+	}
+	return nil
+}
+
+// planError is an error that is caused by a single build when the units of a run are planned.
+type planError struct {
+	// name of the build that caused the error
+	build string
+	error
+}
+
+// Cause returns the underlying cause of the error.
+func (e *planError) Cause() error {
+	return errors.Cause(e.error)
+}
+
+// runState is the state that is shared by all of the units of a single run.
+type runState struct {
+	// context of the run. Commands are stopped and no new units are started when it is done.
+	ctx context.Context
+	// name of the action that is run, which is reported in events
+	actionName string
+	// receives the events for the run. May be nil.
+	listener Listener
+	// if true, units that do not depend on a failed unit are run after a unit fails
+	keepGoing bool
+	// options for retrying failed docker commands that take precedence over the options of the builds
+	retry     RetryOptions
+	executors map[string]Executor
+	// if non-nil, the executor for the units that are only run because selected units depend on them
+	dependencyExecutor Executor
+	tags               *tagStore
+	// records the images for the manifest. Nil if a manifest should not be recorded.
+	manifest *manifestRecorder
+	// tracks the input hashes of the units for incremental builds. Nil if incremental builds are not enabled.
+	incremental *incrementalState
+	// if true, executing a template that references a variable that is not defined returns an error rather than
+	// rendering "<no value>"
+	strictTemplates bool
+}
+
+// buildUnit is a single execution of an action: one build for one outer and inner "for" iteration.
+type buildUnit struct {
+	// index of the unit in the sequential order of the units that are run
+	idx int
+	// index of the unit in the sequential order of all planned units, which identifies the unit in the tag store. Differs
+	// from idx if units are not selected by the "where" filter.
+	planIdx int
+	build   BuildParams
+	buildID string
+	// primary tag of the unit, which is the tag returned by the "Tag" template function
+	tag string
+	// tags other than the primary tag, including aliases
+	additionalTags []string
+	evalVarMap     map[string]string
+	// values of the outer and inner "for" variables for this unit
+	iterVars map[string]string
+	outerIdx int
+	innerIdx int
+	// true if the unit is only run because units that were selected by the "where" filter depend on it
+	dependency bool
+	// partials that are available to the templates of the unit
+	partials map[string]string
+}
+
+func (u buildUnit) runParams(state *runState, stdout io.Writer) runParams {
+	executor := state.executors[u.build.Name]
+	usesDependencyExecutor := u.dependency && state.dependencyExecutor != nil
+	if usesDependencyExecutor {
+		executor = state.dependencyExecutor
+	}
+	var recordImage func(image ManifestImage)
+	// units that are run by the dependency executor or a no-op executor do not process their images, so they are not
+	// recorded in the manifest
+	if _, isNoop := executor.(*noopExecutor); state.manifest != nil && !usesDependencyExecutor && !isNoop {
+		recordImage = func(image ManifestImage) {
+			state.manifest.record(u.idx, image)
+		}
+	}
+	return runParams{
+		idx:            u.idx,
+		executor:       executor,
+		build:          u.build,
+		buildID:        u.buildID,
+		tag:            u.tag,
+		additionalTags: u.additionalTags,
+		evalVarMap:     u.evalVarMap,
+		iterVars:       u.iterVars,
+		partials:       u.partials,
+		inputTags:      state.tags,
+		outerIdx:       u.outerIdx,
+		innerIdx:       u.innerIdx,
+		stdout:         stdout,
+		recordImage:    recordImage,
+		state:          state,
+	}
+}
+
+// planUnits renders the tags for all of the provided builds and returns the units that should be run in the order in
+// which they would be run sequentially. The rendered tags are added to the provided tag store. Relative paths that are
+// read by the templates of the outer "for" variables are resolved relative to the provided directory.
+func planUnits(builds []BuildParams, dir, buildID, tagSuffixTmpl string, partials map[string]string, outerLoop loop, evaluatedVars map[string]string, tags *tagStore) ([]buildUnit, error) {
+	var units []buildUnit
+	err := runInFor(func(idx int, curEvalVarMap map[string]string) error {
 		for _, currBuild := range builds {
-			innerTags, err := runAction(action, executors[currBuild.Name], currBuild, buildID, tagSuffixTmpl, curEvalVarMap, tags, idx, stdout)
+			buildUnits, err := planBuildUnits(currBuild, buildID, tagSuffixTmpl, partials, outerLoop, curEvalVarMap, tags, idx)
 			if err != nil {
-				return errors.Wrapf(err, "failed to build %s", currBuild.Name)
+				return &planError{
+					build: currBuild.Name,
+					error: errors.Wrapf(err, "failed to build %s", currBuild.Name),
+				}
 			}
-			tags[currBuild.Name] = append(tags[currBuild.Name], innerTags)
+			var innerTags []tagEntry
+			for i := range buildUnits {
+				buildUnits[i].idx = len(units) + i
+				buildUnits[i].planIdx = buildUnits[i].idx
+				innerTags = append(innerTags, tagEntry{
+					unitIdx: buildUnits[i].planIdx,
+					tag:     buildUnits[i].tag,
+					vars:    buildUnits[i].iterVars,
+				})
+			}
+			tags.add(currBuild.Name, innerTags)
+			units = append(units, buildUnits...)
 		}
 		return nil
-	}, dockerGenParams.For, buildID, evaluatedVarMap, tags)
+	}, outerLoop, dir, buildID, partials, evaluatedVars, tags)
+	return units, err
 }
 
-func runInFor(f func(int, map[string]string) error, forVars map[string][]string, buildID string, evaluatedVarsIn map[string]string, inputTags map[string][][]string) error {
+func runInFor(f func(int, map[string]string) error, l loop, dir, buildID string, partials, evaluatedVarsIn map[string]string, inputTags *tagStore) error {
 	// copy input map so that modifications made in for loop are not persisted
 	evaluatedVars := make(map[string]string, len(evaluatedVarsIn))
 	for k, v := range evaluatedVarsIn {
 		evaluatedVars[k] = v
 	}
 
-	// if there are no "for" variables, run once
-	if len(forVars) == 0 {
-		return f(0, evaluatedVars)
-	}
-
-	// run build for each for loop variable
-	var sortedForVarNames []string
-	for k := range forVars {
-		sortedForVarNames = append(sortedForVarNames, k)
-	}
-	sort.Strings(sortedForVarNames)
-
-	for i := 0; i < len(forVars[sortedForVarNames[0]]); i++ {
+	for i, iteration := range l.iterations {
 		// set variable values for this iteration
-		for _, currForVar := range sortedForVarNames {
-			currForVarResult, err := executeGoTemplate(forVars[currForVar][i], buildID, evaluatedVars, inputTags, -1, -1)
+		for _, currForVar := range l.varNames {
+			currForVarResult, err := executeGoTemplate(iteration[currForVar], dir, buildID, partials, evaluatedVars, inputTags, -1, -1)
 			if err != nil {
 				return errors.Wrapf(err, "failed to execute template for 'for' variable %s at index %d", currForVar, i)
 			}
@@ -109,128 +333,493 @@ func runInFor(f func(int, map[string]string) error, forVars map[string][]string,
 	return nil
 }
 
-func runAction(action runActionFunc, executor Executor, build BuildParams, buildID, tagSuffixTmpl string, evaluatedVars map[string]string, inputTags map[string][][]string, outerIdx int, stdout io.Writer) ([]string, error) {
-	var tags []string
+func planBuildUnits(build BuildParams, buildID, tagSuffixTmpl string, partials map[string]string, outerLoop loop, evaluatedVars map[string]string, inputTags *tagStore, outerIdx int) ([]buildUnit, error) {
+	innerLoop := newLoop(build.For, build.Matrix)
+	var units []buildUnit
 	err := runInFor(func(innerIdx int, curEvalVarMap map[string]string) error {
-		renderedTag, err := executeGoTemplate(build.Tag, buildID, curEvalVarMap, inputTags, outerIdx, innerIdx)
-		if err != nil {
-			return errors.Wrapf(err, "failed to execute template for tag")
-		}
-		renderedTagSuffix, err := executeGoTemplate(tagSuffixTmpl, buildID, curEvalVarMap, inputTags, outerIdx, innerIdx)
+		renderedTagSuffix, err := executeGoTemplate(tagSuffixTmpl, build.Dir, buildID, partials, curEvalVarMap, inputTags, outerIdx, innerIdx)
 		if err != nil {
 			return errors.Wrapf(err, "failed to execute template for tag suffix")
 		}
-		tag := renderedTag + renderedTagSuffix
-		if tag == "" {
-			return errors.Errorf("tag must be non-empty")
-		}
-		tags = append(tags, tag)
-		return action(runParams{
-			executor:   executor,
-			build:      build,
-			buildID:    buildID,
-			tag:        tag,
-			evalVarMap: curEvalVarMap,
-			inputTags:  inputTags,
-			outerIdx:   outerIdx,
-			innerIdx:   innerIdx,
-			stdout:     stdout,
+
+		// the first tag is the primary tag. Tags have the tag suffix appended, while aliases are used as rendered.
+		var tags []string
+		addTag := func(tag string) {
+			if !containsString(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		tagTmpls := build.Tags
+		if build.Tag != "" || len(build.Tags) == 0 {
+			tagTmpls = append([]string{build.Tag}, build.Tags...)
+		}
+		for _, tagTmpl := range tagTmpls {
+			renderedTag, err := executeGoTemplate(tagTmpl, build.Dir, buildID, partials, curEvalVarMap, inputTags, outerIdx, innerIdx)
+			if err != nil {
+				return errors.Wrapf(err, "failed to execute template for tag")
+			}
+			tag := renderedTag + renderedTagSuffix
+			if tag == "" {
+				return errors.Errorf("tag must be non-empty")
+			}
+			addTag(tag)
+		}
+		for _, aliasTmpl := range build.Aliases {
+			alias, err := executeGoTemplate(aliasTmpl, build.Dir, buildID, partials, curEvalVarMap, inputTags, outerIdx, innerIdx)
+			if err != nil {
+				return errors.Wrapf(err, "failed to execute template for alias")
+			}
+			if alias == "" {
+				// aliases that render to an empty string are skipped so that a floating alias can be used for a single
+				// iteration
+				continue
+			}
+			addTag(alias)
+		}
+		// copy variables because the map is modified by subsequent iterations
+		unitVars := make(map[string]string, len(curEvalVarMap))
+		iterVars := make(map[string]string)
+		for k, v := range curEvalVarMap {
+			unitVars[k] = v
+			if outerLoop.hasVar(k) || innerLoop.hasVar(k) {
+				iterVars[k] = v
+			}
+		}
+		units = append(units, buildUnit{
+			build:          build,
+			buildID:        buildID,
+			tag:            tags[0],
+			additionalTags: tags[1:],
+			evalVarMap:     unitVars,
+			iterVars:       iterVars,
+			partials:       partials,
+			outerIdx:       outerIdx,
+			innerIdx:       innerIdx,
 		})
-	}, build.For, buildID, evaluatedVars, inputTags)
-	return tags, err
+		return nil
+	}, innerLoop, build.Dir, buildID, partials, evaluatedVars, inputTags)
+	return units, err
 }
 
 type runActionFunc func(params runParams) error
 
 type runParams struct {
-	executor   Executor
-	build      BuildParams
-	buildID    string
-	tag        string
-	evalVarMap map[string]string
-	inputTags  map[string][][]string
-	outerIdx   int
-	innerIdx   int
-	stdout     io.Writer
+	idx            int
+	executor       Executor
+	build          BuildParams
+	buildID        string
+	tag            string
+	additionalTags []string
+	evalVarMap     map[string]string
+	iterVars       map[string]string
+	partials       map[string]string
+	inputTags      *tagStore
+	outerIdx       int
+	innerIdx       int
+	stdout         io.Writer
+	// records the image produced by the action in the manifest. Nil if a manifest is not being recorded.
+	recordImage func(image ManifestImage)
+	state       *runState
+}
+
+// allTags returns the primary tag followed by the additional tags of the unit.
+func (p runParams) allTags() []string {
+	return append([]string{p.tag}, p.additionalTags...)
+}
+
+// recordBuildState records the image built for the unit in the state file for incremental builds. Images are not
+// recorded for the no-op executor because it does not build them.
+func (p runParams) recordBuildState(inputHash, imageID string) {
+	if _, isNoop := p.executor.(*noopExecutor); isNoop {
+		return
+	}
+	p.state.incremental.record(p.idx, buildStateImage{
+		InputHash: inputHash,
+		ImageID:   imageID,
+		Tag:       p.tag,
+	})
+}
+
+// runDocker runs the docker command with the provided arguments using the executor for the unit. The command is stopped
+// if the context of the run is done.
+func (p runParams) runDocker(args ...string) error {
+	return AdaptExecutor(p.executor).RunContext(p.state.ctx, Cmd{
+		Name:   "docker",
+		Args:   args,
+		Stdout: p.stdout,
+		Stderr: p.stdout,
+	})
+}
+
+// retryOptions returns the options for retrying failed docker commands for the unit.
+func (p runParams) retryOptions() RetryOptions {
+	return p.state.retry.withDefaults(p.build.Retry)
+}
+
+// render executes the provided template using the variables and tags for the unit.
+func (p runParams) render(tmpl string) (string, error) {
+	if p.state.strictTemplates {
+		return executeStrictGoTemplate(tmpl, p.build.Dir, p.buildID, p.partials, p.evalVarMap, p.inputTags, p.outerIdx, p.innerIdx)
+	}
+	return executeGoTemplate(tmpl, p.build.Dir, p.buildID, p.partials, p.evalVarMap, p.inputTags, p.outerIdx, p.innerIdx)
 }
 
 func runBuildAction(params runParams) error {
-	bytes, err := ioutil.ReadFile(params.build.DockerfileTemplatePath)
+	renderedDockerfile, err := renderDockerfile(params)
+	if err != nil {
+		return err
+	}
+
+	buildOptions, err := params.build.BuildOptions.render(params.render)
 	if err != nil {
-		return errors.Wrapf(err, "failed to read Dockerfile template")
+		return err
+	}
+	contextDir, err := renderContextDir(params)
+	if err != nil {
+		return err
+	}
+	dockerignore, hasDockerignore, err := renderDockerignore(params)
+	if err != nil {
+		return err
 	}
 
-	renderedDockerfile, err := executeGoTemplate(string(bytes), params.buildID, params.evalVarMap, params.inputTags, params.outerIdx, params.innerIdx)
+	renderedFiles, err := renderFiles(params, contextDir)
 	if err != nil {
-		return errors.Wrapf(err, "failed to execute template for Dockerfile")
+		return err
+	}
+
+	if hasDockerignore || len(renderedFiles) > 0 {
+		// the rendered .dockerignore and files are written to a staged copy of the context directory, so the context
+		// directory itself is never modified and builds that share it can run concurrently
+		stageDir, err := stageContext(contextDir, dockerignore, hasDockerignore, renderedFiles)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = os.RemoveAll(stageDir)
+		}()
+		contextDir = stageDir
+	}
+
+	var inputHash string
+	if incremental := params.state.incremental; incremental != nil {
+		inputHash, err = incremental.inputHash(params.idx, renderedDockerfile, dockerignore, buildOptions, contextDir)
+		if err != nil {
+			return errors.Wrapf(err, "failed to compute input hash")
+		}
+		incremental.setHash(params.idx, inputHash)
+		if skipped, err := reuseUnchangedImage(params, inputHash); err != nil || skipped {
+			return err
+		}
+		if buildOptions.Labels == nil {
+			buildOptions.Labels = make(map[string]string)
+		}
+		buildOptions.Labels[inputHashLabel] = inputHash
 	}
 
-	return executeDockerBuild(params.executor, renderedDockerfile, params.tag, params.build.DockerfileTemplatePath, params.stdout)
+	runBuild := params.runDocker
+	if retry := params.retryOptions(); retry.retryBuild() {
+		runBuild = func(args ...string) error {
+			return params.runDockerWithRetries(retry.retries(), retry.backoff(), args...)
+		}
+	}
+	if err := executeDockerBuild(runBuild, renderedDockerfile, params.allTags(), params.build.DockerfileTemplatePath, contextDir, buildOptions); err != nil {
+		return err
+	}
+	if params.recordImage == nil && params.state.incremental == nil {
+		return nil
+	}
+
+	info, err := inspectImage(params.state.ctx, params.executor, params.tag, params.stdout)
+	if err != nil {
+		return err
+	}
+	if params.state.incremental != nil {
+		params.recordBuildState(inputHash, info.ID)
+	}
+	if params.recordImage == nil {
+		return nil
+	}
+	params.recordImage(ManifestImage{
+		Build:          params.build.Name,
+		Vars:           params.iterVars,
+		Tag:            params.tag,
+		AdditionalTags: params.additionalTags,
+		ImageID:        info.ID,
+	})
+	return nil
+}
+
+// reuseUnchangedImage tags the image built by the previous run for the unit with the tags of the unit if the input hash
+// of the previous build matches the provided hash and the image still exists. Returns true if the image was reused, in
+// which case the build should be skipped.
+func reuseUnchangedImage(params runParams, inputHash string) (bool, error) {
+	prev, ok := params.state.incremental.previous(params.idx)
+	if !ok || prev.InputHash != inputHash {
+		return false, nil
+	}
+	source := prev.ImageID
+	if source == "" {
+		source = prev.Tag
+	}
+	if isImageInspector(params.executor) {
+		if _, err := inspectImage(params.state.ctx, params.executor, source, ioutil.Discard); err != nil {
+			// the image no longer exists, so it must be rebuilt
+			return false, nil
+		}
+	}
+
+	_, _ = fmt.Fprintf(params.stdout, "Skipping build of %s: inputs are unchanged since the build of %s\n", params.tag, source)
+	for _, tag := range params.allTags() {
+		if tag == source {
+			continue
+		}
+		args := []string{
+			"tag", source, tag,
+		}
+		if err := params.runDocker(args...); err != nil {
+			return false, errors.Wrapf(err, "failed to execute command %v", args)
+		}
+	}
+	params.recordBuildState(inputHash, prev.ImageID)
+	if params.recordImage != nil {
+		params.recordImage(ManifestImage{
+			Build:          params.build.Name,
+			Vars:           params.iterVars,
+			Tag:            params.tag,
+			AdditionalTags: params.additionalTags,
+			ImageID:        prev.ImageID,
+		})
+	}
+	return true, nil
 }
 
 func runPushAction(params runParams) error {
-	args := []string{
-		"push", params.tag,
+	retry := params.retryOptions()
+	for _, tag := range params.allTags() {
+		args := []string{
+			"push", tag,
+		}
+		if err := params.runDockerWithRetries(retry.retries(), retry.backoff(), args...); err != nil {
+			return errors.Wrapf(err, "failed to execute command %v", args)
+		}
 	}
-	if err := params.executor.Run(params.stdout, "docker", args...); err != nil {
-		return errors.Wrapf(err, "failed to execute command %v", args)
+	if params.recordImage == nil {
+		return nil
+	}
+
+	info, err := inspectImage(params.state.ctx, params.executor, params.tag, params.stdout)
+	if err != nil {
+		return err
 	}
+	params.recordImage(ManifestImage{
+		Build:          params.build.Name,
+		Vars:           params.iterVars,
+		Tag:            params.tag,
+		AdditionalTags: params.additionalTags,
+		ImageID:        info.ID,
+		Digest:         info.digest(params.tag),
+	})
 	return nil
 }
 
 func runTagAction(params runParams) error {
-	_, _ = fmt.Fprintln(params.stdout, params.tag)
+	for _, tag := range params.allTags() {
+		_, _ = fmt.Fprintln(params.stdout, tag)
+	}
+	return nil
+}
+
+func runRenderAction(params runParams, outDir string) error {
+	renderedDockerfile, err := renderDockerfile(params)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(outDir, params.build.Name, renderDirName(params.iterVars))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory %s", dir)
+	}
+	dockerfilePath := filepath.Join(dir, "Dockerfile")
+	if err := ioutil.WriteFile(dockerfilePath, []byte(renderedDockerfile), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write rendered Dockerfile")
+	}
+	_, _ = fmt.Fprintln(params.stdout, dockerfilePath)
+
+	dockerignore, hasDockerignore, err := renderDockerignore(params)
+	if err != nil {
+		return err
+	}
+	if hasDockerignore {
+		dockerignorePath := filepath.Join(dir, dockerignoreFileName)
+		if err := ioutil.WriteFile(dockerignorePath, []byte(dockerignore), 0644); err != nil {
+			return errors.Wrapf(err, "failed to write rendered %s", dockerignoreFileName)
+		}
+		_, _ = fmt.Fprintln(params.stdout, dockerignorePath)
+	}
+
+	if len(params.build.RenderFiles) == 0 {
+		return nil
+	}
+	contextDir, err := renderContextDir(params)
+	if err != nil {
+		return err
+	}
+	renderedFiles, err := renderFiles(params, contextDir)
+	if err != nil {
+		return err
+	}
+	renderedPaths, err := writeRenderedFiles(dir, renderedFiles)
+	if err != nil {
+		return err
+	}
+	for _, renderedPath := range renderedPaths {
+		_, _ = fmt.Fprintln(params.stdout, renderedPath)
+	}
+	return nil
+}
+
+// renderDirName returns the name of the directory used for the rendered output of the build iteration with the
+// provided "for" variables: the variables in the form "key=value" sorted by key and joined with ','. The name does not
+// include the tag because tags typically include the build ID, which differs between runs. Characters in the keys and
+// values that are not letters, digits, '.', '-' or '_' are replaced with '_'. Returns an empty string if there are no
+// variables.
+func renderDirName(iterVars map[string]string) string {
+	sanitize := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+				return r
+			default:
+				return '_'
+			}
+		}, s)
+	}
+	var parts []string
+	for _, k := range sortedKeys(iterVars) {
+		parts = append(parts, sanitize(k)+"="+sanitize(iterVars[k]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// checkRenderDirs returns an error if the rendered outputs of multiple of the provided units would be written to the
+// same directory.
+func checkRenderDirs(units []buildUnit) error {
+	renderDirs := make(map[string]buildUnit)
+	for _, unit := range units {
+		dir := filepath.Join(unit.build.Name, renderDirName(unit.iterVars))
+		if other, ok := renderDirs[dir]; ok {
+			return errors.Errorf("iterations %s and %s of build %s would both be rendered to directory %s", formatVars(other.iterVars), formatVars(unit.iterVars), unit.build.Name, dir)
+		}
+		renderDirs[dir] = unit
+	}
 	return nil
 }
 
-func executeDockerBuild(executor Executor, dockerfileContents, tag, dockerfileTemplatePath string, stdout io.Writer) (rerr error) {
+func renderDockerfile(params runParams) (string, error) {
+	bytes, err := ioutil.ReadFile(params.build.DockerfileTemplatePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read Dockerfile template")
+	}
+
+	renderedDockerfile, err := params.render(string(bytes))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to execute template for Dockerfile")
+	}
+	return renderedDockerfile, nil
+}
+
+// renderContextDir returns the build context directory for the build. If the build does not specify a context, the
+// directory that contains the Dockerfile template is used.
+func renderContextDir(params runParams) (string, error) {
+	if params.build.Context == "" {
+		return filepath.Dir(params.build.DockerfileTemplatePath), nil
+	}
+	contextDir, err := params.render(params.build.Context)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to execute template for context")
+	}
+	if contextDir == "" {
+		return "", errors.Errorf("context must be non-empty")
+	}
+	return resolvePath(params.build.Dir, contextDir), nil
+}
+
+// renderDockerignore returns the rendered .dockerignore template for the build. Returns false if the build does not
+// specify a .dockerignore template.
+func renderDockerignore(params runParams) (string, bool, error) {
+	if params.build.DockerignoreTemplatePath == "" {
+		return "", false, nil
+	}
+	bytes, err := ioutil.ReadFile(params.build.DockerignoreTemplatePath)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "failed to read %s template", dockerignoreFileName)
+	}
+	rendered, err := params.render(string(bytes))
+	if err != nil {
+		return "", false, errors.Wrapf(err, "failed to execute template for %s", dockerignoreFileName)
+	}
+	return rendered, true, nil
+}
+
+func executeDockerBuild(runDocker func(args ...string) error, dockerfileContents string, tags []string, dockerfileTemplatePath, contextDir string, buildOptions DockerBuildOptions) (rerr error) {
 	if dockerfileTemplatePath == "" {
 		return errors.Errorf("dockerFileLoc must be non-empty")
 	}
 
-	f, err := ioutil.TempFile(filepath.Dir(dockerfileTemplatePath), "Dockerfile")
+	// the rendered Dockerfile is written outside of the build context (which is the directory of the template by
+	// default) so that builds that run concurrently do not see the Dockerfiles of other builds in their context
+	dir, err := ioutil.TempDir("", "dockergen-dockerfile-")
 	if err != nil {
-		return errors.Wrapf(err, "failed to create temporary file for rendered Dockerfile")
+		return errors.Wrapf(err, "failed to create temporary directory for rendered Dockerfile")
 	}
 	defer func() {
-		if err := os.Remove(f.Name()); err != nil && rerr == nil {
-			rerr = errors.Wrapf(err, "failed to remove temporary file for rendered Dockerfile")
+		if err := os.RemoveAll(dir); err != nil && rerr == nil {
+			rerr = errors.Wrapf(err, "failed to remove temporary directory for rendered Dockerfile")
 		}
 	}()
 
-	if _, err := f.WriteString(dockerfileContents); err != nil {
+	dockerfilePath := filepath.Join(dir, "Dockerfile")
+	if err := ioutil.WriteFile(dockerfilePath, []byte(dockerfileContents), 0644); err != nil {
 		return errors.Wrapf(err, "failed to write Dockerfile")
 	}
-	if err := f.Close(); err != nil {
-		return errors.Wrapf(err, "failed to close file")
-	}
 
 	args := []string{
-		"build", "-t", tag, "-f", f.Name(), filepath.Dir(dockerfileTemplatePath),
+		"build",
+	}
+	for _, tag := range tags {
+		args = append(args, "-t", tag)
 	}
-	if err := executor.Run(stdout, "docker", args...); err != nil {
+	args = append(args, buildOptions.args()...)
+	args = append(args, "-f", dockerfilePath, contextDir)
+	if err := runDocker(args...); err != nil {
 		return errors.Wrapf(err, "failed to execute command %v", args)
 	}
 	return nil
 }
 
-func executeGoTemplate(tmplContent, buildID string, vars map[string]string, inputTags map[string][][]string, outerIdx, innerIdx int) (string, error) {
-	funcs := template.FuncMap{
+// executeGoTemplate executes the provided template. Relative paths that are read by the template are resolved relative
+// to the provided directory. The provided partials, which map names to template content, are defined as named templates
+// that the template can invoke.
+func executeGoTemplate(tmplContent, dir, buildID string, partials, vars map[string]string, inputTags *tagStore, outerIdx, innerIdx int) (string, error) {
+	return executeGoTemplateWithMissingKey(tmplContent, "default", dir, buildID, partials, vars, inputTags, outerIdx, innerIdx)
+}
+
+// executeStrictGoTemplate executes the provided template like executeGoTemplate, but returns an error if the template
+// references a variable that is not defined.
+func executeStrictGoTemplate(tmplContent, dir, buildID string, partials, vars map[string]string, inputTags *tagStore, outerIdx, innerIdx int) (string, error) {
+	return executeGoTemplateWithMissingKey(tmplContent, "error", dir, buildID, partials, vars, inputTags, outerIdx, innerIdx)
+}
+
+// executeGoTemplateWithMissingKey executes the provided template with the provided value for the "missingkey" option
+// of the template.
+func executeGoTemplateWithMissingKey(tmplContent, missingKey, dir, buildID string, partials, vars map[string]string, inputTags *tagStore, outerIdx, innerIdx int) (string, error) {
+	funcs := libraryFuncs(dir)
+	for k, v := range (template.FuncMap{
 		"Getenv":  os.Getenv,
 		"BuildID": func() string { return buildID },
-		"Tag": func(image string, i, j int) (string, error) {
-			tagSlice, ok := inputTags[image]
-			if !ok {
-				return "", fmt.Errorf("unknown image name %s", image)
-			}
-			if i >= len(tagSlice) {
-				return "", fmt.Errorf("outer index out of bounds: %d > %d", i, len(tagSlice))
-			}
-			if j >= len(tagSlice[i]) {
-				return "", fmt.Errorf("inner index out of bounds: %d > %d", j, len(tagSlice[i]))
-			}
-			return tagSlice[i][j], nil
-		},
+		"Tag":     inputTags.get,
+		"TagFor":  inputTags.getFor,
 		"OuterIdx": func() (int, error) {
 			if outerIdx < 0 {
 				return 0, fmt.Errorf("OuterIdx was not set")
@@ -243,9 +832,17 @@ func executeGoTemplate(tmplContent, buildID string, vars map[string]string, inpu
 			}
 			return innerIdx, nil
 		},
+	}) {
+		funcs[k] = v
 	}
-	tmpl, err := template.New("env").Funcs(funcs).Parse(tmplContent)
-	if err != nil {
+	tmpl := template.New("env").Funcs(funcs).Option("missingkey=" + missingKey)
+	for _, name := range sortedKeys(partials) {
+		// the option is set for every partial because it applies to the template that is being executed
+		if _, err := tmpl.New(name).Option("missingkey=" + missingKey).Parse(partials[name]); err != nil {
+			return "", errors.Wrapf(err, "failed to parse partial %s", name)
+		}
+	}
+	if _, err := tmpl.Parse(tmplContent); err != nil {
 		return "", errors.Wrapf(err, "failed to parse template")
 	}
 	buf := &bytes.Buffer{}
@@ -254,3 +851,140 @@ func executeGoTemplate(tmplContent, buildID string, vars map[string]string, inpu
 	}
 	return buf.String(), nil
 }
+
+// tagStore stores the primary tags rendered for each build indexed by outer and inner "for" index. It is safe for
+// concurrent use.
+type tagStore struct {
+	mu   sync.RWMutex
+	tags map[string][][]tagEntry
+	// if non-nil, called with the index of the unit that produces each tag that is looked up
+	onLookup func(unitIdx int)
+}
+
+// tagEntry is the primary tag for a single iteration of a build along with the values of the "for" variables for the
+// iteration.
+type tagEntry struct {
+	// index of the unit that produces the tag in the sequential order of all planned units
+	unitIdx int
+	tag     string
+	vars    map[string]string
+}
+
+func newTagStore() *tagStore {
+	return &tagStore{
+		tags: make(map[string][][]tagEntry),
+	}
+}
+
+// tracking returns a store that contains the same tags as this store and calls the provided function with the index of
+// the unit that produces each tag that is looked up in it. Tags must not be added to this store after it is called.
+func (s *tagStore) tracking(onLookup func(unitIdx int)) *tagStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &tagStore{
+		tags:     s.tags,
+		onLookup: onLookup,
+	}
+}
+
+func (s *tagStore) lookedUp(entry tagEntry) {
+	if s.onLookup != nil {
+		s.onLookup(entry.unitIdx)
+	}
+}
+
+func (s *tagStore) add(image string, innerTags []tagEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags[image] = append(s.tags[image], innerTags)
+}
+
+func (s *tagStore) get(image string, i, j int) (string, error) {
+	if s == nil {
+		return "", fmt.Errorf("unknown image name %s", image)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tagSlice, ok := s.tags[image]
+	if !ok {
+		return "", fmt.Errorf("unknown image name %s", image)
+	}
+	if i < 0 || j < 0 {
+		return "", fmt.Errorf("index must be non-negative: [%d][%d]", i, j)
+	}
+	if i >= len(tagSlice) {
+		return "", fmt.Errorf("outer index out of bounds: %d > %d", i, len(tagSlice))
+	}
+	if j >= len(tagSlice[i]) {
+		return "", fmt.Errorf("inner index out of bounds: %d > %d", j, len(tagSlice[i]))
+	}
+	s.lookedUp(tagSlice[i][j])
+	return tagSlice[i][j].tag, nil
+}
+
+// getFor returns the tag for the iteration of the provided image whose "for" variables have the provided values. The
+// variables are specified as alternating names and values. Returns an error if no iteration matches or if iterations
+// with different tags match.
+func (s *tagStore) getFor(image string, varNamesAndVals ...string) (string, error) {
+	if len(varNamesAndVals)%2 != 0 {
+		return "", fmt.Errorf("variables must be specified as name and value pairs, was %v", varNamesAndVals)
+	}
+	want := make(map[string]string)
+	for i := 0; i < len(varNamesAndVals); i += 2 {
+		want[varNamesAndVals[i]] = varNamesAndVals[i+1]
+	}
+	if s == nil {
+		return "", fmt.Errorf("unknown image name %s", image)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tagSlice, ok := s.tags[image]
+	if !ok {
+		return "", fmt.Errorf("unknown image name %s", image)
+	}
+
+	var matches, available []string
+	var matchedEntries []tagEntry
+	for _, innerTags := range tagSlice {
+		for _, entry := range innerTags {
+			available = append(available, formatVars(entry.vars))
+			if !matchesAny(entry.vars, []map[string]string{want}) {
+				continue
+			}
+			matchedEntries = append(matchedEntries, entry)
+			if !containsString(matches, entry.tag) {
+				matches = append(matches, entry.tag)
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no iteration of image %s matches %s. Available combinations:\n\t%s", image, formatVars(want), strings.Join(available, "\n\t"))
+	case 1:
+		for _, entry := range matchedEntries {
+			s.lookedUp(entry)
+		}
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("multiple iterations of image %s with different tags match %s: %v", image, formatVars(want), matches)
+	}
+}
+
+// formatVars returns a string representation of the provided variables of the form "{k1=v1, k2=v2}" with the keys in
+// sorted order.
+func formatVars(vars map[string]string) string {
+	var parts []string
+	for _, k := range sortedKeys(vars) {
+		parts = append(parts, k+"="+vars[k])
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+func containsString(s []string, want string) bool {
+	for _, curr := range s {
+		if curr == want {
+			return true
+		}
+	}
+	return false
+}
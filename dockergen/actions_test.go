@@ -0,0 +1,917 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+// recordingExecutor records the arguments of every command that it runs and the start and end of every command. The
+// events are recorded as "start <tag>" and "end <tag>".
+type recordingExecutor struct {
+	mu       sync.Mutex
+	events   []string
+	commands [][]string
+	// if non-nil, the tag of every command is sent to started after its start is recorded and the command does not end
+	// until a value is received from release
+	started chan string
+	release chan struct{}
+}
+
+func (e *recordingExecutor) Run(w io.Writer, name string, args ...string) error {
+	e.mu.Lock()
+	e.commands = append(e.commands, append([]string{name}, args...))
+	e.mu.Unlock()
+
+	tag := args[len(args)-1]
+	for i, arg := range args {
+		if arg == "-t" {
+			tag = args[i+1]
+			break
+		}
+	}
+	e.record("start " + tag)
+	if e.started != nil {
+		e.started <- tag
+		<-e.release
+	}
+	e.record("end " + tag)
+	return nil
+}
+
+func (e *recordingExecutor) record(event string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, event)
+}
+
+func (e *recordingExecutor) indexOf(event string) int {
+	for i, curr := range e.events {
+		if curr == event {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestBuildParallel(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+
+	for i, tc := range []struct {
+		name        string
+		yml         string
+		parallelism int
+		// pairs of tags where the first tag must be finished building before the second tag starts building
+		wantBefore [][2]string
+		wantTags   []string
+	}{
+		{
+			"sequential build maintains order",
+			`
+for:
+  version:
+    - "1"
+    - "2"
+builds:
+  bar:
+    docker-template: Dockerfile_template.txt
+    tag: test/bar:{{.version}}
+  foo:
+    docker-template: Dockerfile_template.txt
+    tag: test/foo:{{.version}}
+    requires:
+      - bar
+`,
+			1,
+			[][2]string{
+				{"test/bar:1-unspecified", "test/foo:1-unspecified"},
+				{"test/foo:1-unspecified", "test/bar:2-unspecified"},
+				{"test/bar:2-unspecified", "test/foo:2-unspecified"},
+			},
+			[]string{
+				"test/bar:1-unspecified",
+				"test/bar:2-unspecified",
+				"test/foo:1-unspecified",
+				"test/foo:2-unspecified",
+			},
+		},
+		{
+			"parallel build respects requires",
+			`
+for:
+  version:
+    - "1"
+    - "2"
+builds:
+  bar:
+    docker-template: Dockerfile_template.txt
+    tag: test/bar:{{.version}}
+  baz:
+    docker-template: Dockerfile_template.txt
+    tag: test/baz:{{.version}}-{{.inner}}
+    for:
+      inner:
+        - a
+        - b
+  foo:
+    docker-template: Dockerfile_template.txt
+    tag: test/foo:{{.version}}
+    requires:
+      - bar
+      - baz
+`,
+			4,
+			[][2]string{
+				{"test/bar:1-unspecified", "test/foo:1-unspecified"},
+				{"test/baz:1-a-unspecified", "test/foo:1-unspecified"},
+				{"test/baz:1-b-unspecified", "test/foo:1-unspecified"},
+				{"test/bar:2-unspecified", "test/foo:2-unspecified"},
+				{"test/baz:2-a-unspecified", "test/foo:2-unspecified"},
+				{"test/baz:2-b-unspecified", "test/foo:2-unspecified"},
+			},
+			[]string{
+				"test/bar:1-unspecified",
+				"test/bar:2-unspecified",
+				"test/baz:1-a-unspecified",
+				"test/baz:1-b-unspecified",
+				"test/baz:2-a-unspecified",
+				"test/baz:2-b-unspecified",
+				"test/foo:1-unspecified",
+				"test/foo:2-unspecified",
+			},
+		},
+	} {
+		err := ioutil.WriteFile(path.Join(tmpDir, "Dockerfile_template.txt"), []byte("FROM scratch\n"), 0644)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		tc.yml = strings.Replace(tc.yml, "Dockerfile_template.txt", path.Join(tmpDir, "Dockerfile_template.txt"), -1)
+
+		var cfg dockergen.Config
+		err = yaml.Unmarshal([]byte(tc.yml), &cfg)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		bParams, err := cfg.BuildParams()
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		executor := &recordingExecutor{
+			started: make(chan string),
+			release: make(chan struct{}),
+		}
+		executors := make(map[string]dockergen.Executor)
+		for _, param := range bParams {
+			executors[param.Name] = executor
+		}
+		params := cfg.ToParams()
+		params.Parallelism = tc.parallelism
+		done := make(chan error)
+		go func() {
+			done <- dockergen.Build(executors, dockergen.TopologicalSort(bParams), params, ioutil.Discard)
+		}()
+
+		// units are only released when no other unit has started for a while, so a unit that is started before a unit
+		// that it requires completes is recorded as starting before the end of that unit
+		inFlight := 0
+		for running := true; running; {
+			select {
+			case <-executor.started:
+				inFlight++
+			case err = <-done:
+				running = false
+			case <-time.After(50 * time.Millisecond):
+				if inFlight > 0 {
+					executor.release <- struct{}{}
+					inFlight--
+				}
+			}
+		}
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		for _, before := range tc.wantBefore {
+			endIdx := executor.indexOf("end " + before[0])
+			startIdx := executor.indexOf("start " + before[1])
+			require.NotEqual(t, -1, endIdx, "Case %d: %s", i, tc.name)
+			require.NotEqual(t, -1, startIdx, "Case %d: %s", i, tc.name)
+			assert.True(t, endIdx < startIdx, "Case %d: %s\n%s was not built before %s: %v", i, tc.name, before[0], before[1], executor.events)
+		}
+
+		var gotTags []string
+		for _, event := range executor.events {
+			if strings.HasPrefix(event, "start ") {
+				gotTags = append(gotTags, strings.TrimPrefix(event, "start "))
+			}
+		}
+		assert.ElementsMatch(t, tc.wantTags, gotTags, "Case %d: %s", i, tc.name)
+	}
+}
+
+func TestBuildParallelLimit(t *testing.T) {
+	var cfg dockergen.Config
+	err := yaml.Unmarshal([]byte(`
+builds:
+  foo:
+    tag: test/foo:{{.version}}
+    for:
+      version:
+        - "1"
+        - "2"
+        - "3"
+        - "4"
+        - "5"
+`), &cfg)
+	require.NoError(t, err)
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	const parallelism = 2
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	started := make(chan string)
+	release := make(chan struct{})
+	// every push blocks until it is released, so the units that are started before a unit is released are in flight at
+	// the same time
+	executor := funcExecutor(func(w io.Writer, name string, args ...string) error {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		started <- args[len(args)-1]
+		<-release
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return nil
+	})
+	params := cfg.ToParams()
+	params.Parallelism = parallelism
+	done := make(chan error)
+	go func() {
+		done <- dockergen.Push(map[string]dockergen.Executor{"foo": executor}, bParams, params, ioutil.Discard)
+	}()
+
+	waitForStart := func() string {
+		select {
+		case tag := <-started:
+			return tag
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "timed out waiting for a unit to start")
+			return ""
+		}
+	}
+	assertNoStart := func() {
+		select {
+		case tag := <-started:
+			assert.Fail(t, fmt.Sprintf("%s was started while %d units were in flight", tag, parallelism))
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	var gotTags []string
+	// independent units are started without waiting for the units that are in flight to complete
+	for i := 0; i < parallelism; i++ {
+		gotTags = append(gotTags, waitForStart())
+	}
+	assertNoStart()
+	// a new unit is started only when a unit that is in flight completes
+	for len(gotTags) < 5 {
+		release <- struct{}{}
+		gotTags = append(gotTags, waitForStart())
+		assertNoStart()
+	}
+	for i := 0; i < parallelism; i++ {
+		release <- struct{}{}
+	}
+	require.NoError(t, <-done)
+
+	assert.Equal(t, parallelism, maxInFlight)
+	assert.ElementsMatch(t, []string{
+		"test/foo:1-unspecified",
+		"test/foo:2-unspecified",
+		"test/foo:3-unspecified",
+		"test/foo:4-unspecified",
+		"test/foo:5-unspecified",
+	}, gotTags)
+}
+
+func TestRender(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(path.Join(tmpDir, "Dockerfile_template.txt"), []byte("FROM {{.base}}\n"), 0644)
+	require.NoError(t, err)
+
+	yml := strings.Replace(`
+builds:
+  foo:
+    docker-template: Dockerfile_template.txt
+    tag: test/foo:{{.base}}
+    for:
+      base:
+        - alpine
+        - debian
+`, "Dockerfile_template.txt", path.Join(tmpDir, "Dockerfile_template.txt"), -1)
+
+	var cfg dockergen.Config
+	err = yaml.Unmarshal([]byte(yml), &cfg)
+	require.NoError(t, err)
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	outDir := path.Join(tmpDir, "out")
+	err = dockergen.Render(bParams, cfg.ToParams(), outDir, ioutil.Discard)
+	require.NoError(t, err)
+
+	for file, want := range map[string]string{
+		"foo/base=alpine/Dockerfile": "FROM alpine\n",
+		"foo/base=debian/Dockerfile": "FROM debian\n",
+	} {
+		got, err := ioutil.ReadFile(path.Join(outDir, file))
+		require.NoError(t, err, file)
+		assert.Equal(t, want, string(got), file)
+	}
+
+	// iterations whose directory names are the same after invalid characters are replaced are an error
+	yml = strings.Replace(`
+builds:
+  foo:
+    docker-template: Dockerfile_template.txt
+    tag: test/foo:{{.base}}
+    for:
+      base:
+        - alpine/3
+        - alpine_3
+`, "Dockerfile_template.txt", path.Join(tmpDir, "Dockerfile_template.txt"), -1)
+	cfg = dockergen.Config{}
+	require.NoError(t, yaml.Unmarshal([]byte(yml), &cfg))
+	bParams, err = cfg.BuildParams()
+	require.NoError(t, err)
+	err = dockergen.Render(bParams, cfg.ToParams(), path.Join(tmpDir, "out2"), ioutil.Discard)
+	require.Error(t, err)
+	assert.Equal(t, "iterations {base=alpine/3} and {base=alpine_3} of build foo would both be rendered to directory foo/base=alpine_3", err.Error())
+	_, err = os.Stat(path.Join(tmpDir, "out2"))
+	assert.True(t, os.IsNotExist(err), "output was rendered despite the collision")
+}
+
+func TestBuildOptions(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(path.Join(tmpDir, "Dockerfile_template.txt"), []byte("FROM scratch\n"), 0644)
+	require.NoError(t, err)
+
+	yml := strings.Replace(`
+build-args:
+  VERSION: "{{.version}}"
+  DEFAULT: default
+labels:
+  maintainer: test
+pull: true
+builds:
+  foo:
+    docker-template: Dockerfile_template.txt
+    tag: test/foo:{{.version}}
+    for:
+      version:
+        - "1"
+    build-args:
+      DEFAULT: override
+    target: release-{{.version}}
+    network: host
+    platform: linux/amd64
+    no-cache: true
+  bar:
+    docker-template: Dockerfile_template.txt
+    tag: test/bar
+    pull: false
+`, "Dockerfile_template.txt", path.Join(tmpDir, "Dockerfile_template.txt"), -1)
+
+	var cfg dockergen.Config
+	err = yaml.Unmarshal([]byte(yml), &cfg)
+	require.NoError(t, err)
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	executor := &recordingExecutor{}
+	executors := map[string]dockergen.Executor{
+		"foo": executor,
+		"bar": executor,
+	}
+	params := cfg.ToParams()
+	params.TemplateVars = map[string]string{"version": "0"}
+	err = dockergen.Build(executors, bParams, params, ioutil.Discard)
+	require.NoError(t, err)
+
+	require.Equal(t, 2, len(executor.commands))
+	assert.Equal(t, []string{
+		"docker", "build", "-t", "test/foo:1-unspecified",
+		"--build-arg", "DEFAULT=override",
+		"--build-arg", "VERSION=1",
+		"--label", "maintainer=test",
+		"--target", "release-1",
+		"--network", "host",
+		"--platform", "linux/amd64",
+		"--no-cache",
+		"--pull",
+	}, executor.commands[0][:len(executor.commands[0])-3])
+	assert.Equal(t, []string{
+		"docker", "build", "-t", "test/bar-unspecified",
+		"--build-arg", "DEFAULT=default",
+		"--build-arg", "VERSION=0",
+		"--label", "maintainer=test",
+	}, executor.commands[1][:len(executor.commands[1])-3])
+}
+
+// funcExecutor is an executor that calls the function when run.
+type funcExecutor func(w io.Writer, name string, args ...string) error
+
+func (f funcExecutor) Run(w io.Writer, name string, args ...string) error {
+	return f(w, name, args...)
+}
+
+func TestBuildContextAndDockerignoreTemplate(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+
+	for name, content := range map[string]string{
+		"templates/Dockerfile_template.txt": "FROM scratch\n",
+		"templates/dockerignore.txt":        "*\n!{{.version}}\n",
+		"src/1/file.txt":                    "1",
+	} {
+		require.NoError(t, os.MkdirAll(path.Dir(path.Join(tmpDir, name)), 0755))
+		require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, name), []byte(content), 0644))
+	}
+
+	yml := strings.Replace(`
+builds:
+  foo:
+    docker-template: TMP_DIR/templates/Dockerfile_template.txt
+    dockerignore-template: TMP_DIR/templates/dockerignore.txt
+    context: TMP_DIR/{{.srcDir}}
+    tag: test/foo:{{.version}}
+    for:
+      version:
+        - "1"
+`, "TMP_DIR", tmpDir, -1)
+
+	var cfg dockergen.Config
+	err = yaml.Unmarshal([]byte(yml), &cfg)
+	require.NoError(t, err)
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	var gotContextDir, gotDockerignore string
+	var gotFileErr error
+	executors := map[string]dockergen.Executor{
+		"foo": funcExecutor(func(w io.Writer, name string, args ...string) error {
+			gotContextDir = args[len(args)-1]
+			_, gotFileErr = os.Stat(path.Join(gotContextDir, "1", "file.txt"))
+			bytes, err := ioutil.ReadFile(path.Join(gotContextDir, ".dockerignore"))
+			if err != nil {
+				return err
+			}
+			gotDockerignore = string(bytes)
+			return nil
+		}),
+	}
+	params := cfg.ToParams()
+	params.TemplateVars = map[string]string{"srcDir": "src"}
+	err = dockergen.Build(executors, bParams, params, ioutil.Discard)
+	require.NoError(t, err)
+
+	// the build uses a staged copy of the context that contains the rendered .dockerignore
+	assert.NotEqual(t, path.Join(tmpDir, "src"), gotContextDir)
+	assert.Equal(t, "*\n!1\n", gotDockerignore)
+	assert.NoError(t, gotFileErr)
+	_, err = os.Stat(gotContextDir)
+	assert.True(t, os.IsNotExist(err), "staged context was not removed")
+	_, err = os.Stat(path.Join(tmpDir, "src", ".dockerignore"))
+	assert.True(t, os.IsNotExist(err), "rendered .dockerignore was written to the context")
+
+	// the rendered .dockerignore replaces a .dockerignore in the context without modifying it
+	err = ioutil.WriteFile(path.Join(tmpDir, "src", ".dockerignore"), []byte("foo"), 0644)
+	require.NoError(t, err)
+	err = dockergen.Build(executors, bParams, params, ioutil.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, "*\n!1\n", gotDockerignore)
+	bytes, err := ioutil.ReadFile(path.Join(tmpDir, "src", ".dockerignore"))
+	require.NoError(t, err)
+	assert.Equal(t, "foo", string(bytes))
+}
+
+func TestRenderedDockerfileIsNotInContext(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(path.Join(tmpDir, "Dockerfile_template.txt"), []byte("FROM {{.base}}\n"), 0644)
+	require.NoError(t, err)
+
+	var cfg dockergen.Config
+	err = yaml.Unmarshal([]byte(`
+builds:
+  foo:
+    docker-template: Dockerfile_template.txt
+    tag: test/foo:{{.base}}
+    for:
+      base:
+        - alpine
+        - debian
+`), &cfg)
+	require.NoError(t, err)
+	cfg.Dir = tmpDir
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	dockerfiles := make(map[string]string)
+	var contextDirs []string
+	executor := funcExecutor(func(w io.Writer, name string, args ...string) error {
+		dockerfilePath := args[len(args)-2]
+		bytes, err := ioutil.ReadFile(dockerfilePath)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		dockerfiles[dockerfilePath] = string(bytes)
+		contextDirs = append(contextDirs, args[len(args)-1])
+		return nil
+	})
+	params := cfg.ToParams()
+	params.Parallelism = 2
+	err = dockergen.Build(map[string]dockergen.Executor{"foo": executor}, bParams, params, ioutil.Discard)
+	require.NoError(t, err)
+
+	// the template directory is the context, so the rendered Dockerfiles are written elsewhere and removed after the
+	// builds complete
+	assert.Equal(t, []string{tmpDir, tmpDir}, contextDirs)
+	var gotContents []string
+	for dockerfilePath, content := range dockerfiles {
+		assert.False(t, strings.HasPrefix(dockerfilePath, tmpDir+"/"), "%s is in the context", dockerfilePath)
+		_, err := os.Stat(dockerfilePath)
+		assert.True(t, os.IsNotExist(err), "%s was not removed", dockerfilePath)
+		gotContents = append(gotContents, content)
+	}
+	assert.ElementsMatch(t, []string{"FROM alpine\n", "FROM debian\n"}, gotContents)
+	files, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(files))
+	assert.Equal(t, "Dockerfile_template.txt", files[0].Name())
+}
+
+func TestMultipleTags(t *testing.T) {
+	yml := `
+tag-suffix: -t13
+builds:
+  foo:
+    tag: test/foo:{{.jdk}}
+    tags:
+      - other/foo:{{.jdk}}
+    aliases:
+      - test/foo:{{.jdk}}-latest
+      - test/foo:latest
+    for:
+      jdk:
+        - jdk8
+  bar:
+    tags:
+      - test/bar:first
+      - test/bar:second
+`
+	var cfg dockergen.Config
+	err := yaml.Unmarshal([]byte(yml), &cfg)
+	require.NoError(t, err)
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	err = dockergen.Tags(nil, bParams, cfg.ToParams(), buf)
+	require.NoError(t, err)
+	assert.Equal(t, `test/foo:jdk8-t13
+other/foo:jdk8-t13
+test/foo:jdk8-latest
+test/foo:latest
+test/bar:first-t13
+test/bar:second-t13
+`, buf.String())
+
+	executor := &recordingExecutor{}
+	err = dockergen.Push(map[string]dockergen.Executor{"foo": executor, "bar": executor}, bParams, cfg.ToParams(), ioutil.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"docker", "push", "test/foo:jdk8-t13"},
+		{"docker", "push", "other/foo:jdk8-t13"},
+		{"docker", "push", "test/foo:jdk8-latest"},
+		{"docker", "push", "test/foo:latest"},
+		{"docker", "push", "test/bar:first-t13"},
+		{"docker", "push", "test/bar:second-t13"},
+	}, executor.commands)
+}
+
+func TestDuplicateTags(t *testing.T) {
+	for i, tc := range []struct {
+		name      string
+		yml       string
+		want      string
+		wantError string
+	}{
+		{
+			"alias that renders to an empty string is skipped",
+			`
+tag-suffix: -t1
+builds:
+  foo:
+    tag: test/foo:{{.jdk}}
+    aliases:
+      - '{{if eq .jdk "jdk11"}}test/foo:latest{{end}}'
+    for:
+      jdk:
+        - jdk8
+        - jdk11
+`,
+			"test/foo:jdk8-t1\ntest/foo:jdk11-t1\ntest/foo:latest\n",
+			"",
+		},
+		{
+			"alias that is the same for every iteration",
+			`
+builds:
+  foo:
+    tag: test/foo:{{.jdk}}
+    aliases:
+      - test/foo:latest
+    for:
+      jdk:
+        - jdk8
+        - jdk11
+`,
+			"",
+			"tag test/foo:latest is used by both foo {jdk=jdk8} and foo {jdk=jdk11}",
+		},
+		{
+			"tag of one build that is an alias of another",
+			`
+tag-suffix: -t1
+builds:
+  foo:
+    tag: test/foo
+  bar:
+    tag: test/bar
+    aliases:
+      - test/foo-t1
+`,
+			"",
+			"tag test/foo-t1 is used by both foo and bar",
+		},
+	} {
+		var cfg dockergen.Config
+		require.NoError(t, yaml.Unmarshal([]byte(tc.yml), &cfg), "Case %d: %s", i, tc.name)
+		bParams, err := cfg.BuildParams()
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		buf := &bytes.Buffer{}
+		err = dockergen.Tags(nil, bParams, cfg.ToParams(), buf)
+		if tc.wantError != "" {
+			require.Error(t, err, fmt.Sprintf("Case %d: %s", i, tc.name))
+			assert.EqualError(t, err, tc.wantError, "Case %d: %s", i, tc.name)
+			continue
+		}
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.want, buf.String(), "Case %d: %s", i, tc.name)
+	}
+}
+
+func TestTagFor(t *testing.T) {
+	for i, tc := range []struct {
+		name      string
+		appAlias  string
+		want      string
+		wantError string
+	}{
+		{
+			"selects iteration by variable values",
+			`{{ TagFor "base" "jdk" "jdk8" "distro" "alpine" }}`,
+			"test/app-from-test/base:jdk8-alpine-t1",
+			"",
+		},
+		{
+			"selects iteration by subset of variable values",
+			`{{ TagFor "base" "jdk" "jdk7" }}`,
+			"test/app-from-test/base:jdk7-alpine-t1",
+			"",
+		},
+		{
+			"no matching iteration lists available combinations",
+			`{{ TagFor "base" "jdk" "jdk11" }}`,
+			"",
+			`no iteration of image base matches \{jdk=jdk11\}. Available combinations:
+	\{distro=alpine, jdk=jdk7\}
+	\{distro=alpine, jdk=jdk8\}
+	\{distro=debian, jdk=jdk8\}`,
+		},
+		{
+			"multiple matching iterations",
+			`{{ TagFor "base" "jdk" "jdk8" }}`,
+			"",
+			`multiple iterations of image base with different tags match \{jdk=jdk8\}: \[test/base:jdk8-alpine-t1 test/base:jdk8-debian-t1\]`,
+		},
+		{
+			"odd number of arguments",
+			`{{ TagFor "base" "jdk" }}`,
+			"",
+			`variables must be specified as name and value pairs, was \[jdk\]`,
+		},
+	} {
+		yml := `
+tag-suffix: -t1
+builds:
+  base:
+    tag: test/base:{{.jdk}}-{{.distro}}
+    matrix:
+      jdk:
+        - jdk7
+        - jdk8
+      distro:
+        - alpine
+        - debian
+      exclude:
+        - jdk: jdk7
+          distro: debian
+  app:
+    tag: test/app:latest
+    aliases:
+      - 'test/app-from-` + tc.appAlias + `'
+    requires:
+      - base
+`
+		var cfg dockergen.Config
+		err := yaml.Unmarshal([]byte(yml), &cfg)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		bParams, err := cfg.BuildParams()
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		buf := &bytes.Buffer{}
+		err = dockergen.Tags(nil, bParams, cfg.ToParams(), buf)
+		if tc.wantError != "" {
+			require.Error(t, err, fmt.Sprintf("Case %d: %s", i, tc.name))
+			assert.Regexp(t, tc.wantError, err.Error(), "Case %d: %s", i, tc.name)
+			continue
+		}
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		assert.Equal(t, tc.want, lines[len(lines)-1], "Case %d: %s", i, tc.name)
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	var cfg dockergen.Config
+	err := yaml.Unmarshal([]byte(`
+tag-suffix: -t1
+builds:
+  base:
+    tag: test/base:{{.version}}
+    for:
+      version:
+        - "1"
+        - "2"
+  app:
+    tag: test/app
+    requires:
+      - base
+  leaf:
+    tag: test/leaf
+    requires:
+      - app
+  other:
+    tag: test/other
+`), &cfg)
+	require.NoError(t, err)
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	for _, parallelism := range []int{1, 4} {
+		var mu sync.Mutex
+		var pushed []string
+		executor := funcExecutor(func(w io.Writer, name string, args ...string) error {
+			if args[1] == "test/base:2-t1" {
+				return fmt.Errorf("push failed")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			pushed = append(pushed, args[1])
+			return nil
+		})
+		executors := map[string]dockergen.Executor{"base": executor, "app": executor, "leaf": executor, "other": executor}
+
+		params := cfg.ToParams()
+		params.Parallelism = parallelism
+		params.KeepGoing = true
+		var skipped []string
+		params.Listener = dockergen.ListenerFunc(func(e dockergen.Event) {
+			if e.Type == dockergen.EventSkipped {
+				skipped = append(skipped, e.Tag)
+			}
+		})
+		buf := &bytes.Buffer{}
+		err = dockergen.Push(executors, bParams, params, buf)
+		require.EqualError(t, err, "1 of 5 build iterations failed and 2 were skipped", "parallelism %d", parallelism)
+
+		assert.ElementsMatch(t, []string{"test/base:1-t1", "test/other-t1"}, pushed, "parallelism %d", parallelism)
+		assert.Equal(t, []string{"test/app-t1", "test/leaf-t1"}, skipped, "parallelism %d", parallelism)
+		assert.Equal(t, `
+BUILD  VARS         TAG             STATUS
+base   {version=1}  test/base:1-t1  succeeded
+base   {version=2}  test/base:2-t1  failed
+app    {}           test/app-t1     skipped
+leaf   {}           test/leaf-t1    skipped
+other  {}           test/other-t1   succeeded
+
+base {version=2} (test/base:2-t1) failed: failed to execute command [push test/base:2-t1]: push failed
+`, buf.String(), "parallelism %d", parallelism)
+	}
+}
+
+func TestKeepGoingOuterIterations(t *testing.T) {
+	var cfg dockergen.Config
+	err := yaml.Unmarshal([]byte(`
+tag-suffix: -t1
+for:
+  jdk:
+    - jdk8
+    - jdk11
+builds:
+  base:
+    tag: test/base:{{.jdk}}
+  app:
+    tag: test/app:{{.jdk}}
+    requires:
+      - base
+  legacy:
+    tag: test/legacy:{{.jdk}}
+    requires:
+      - base
+    build-args:
+      BASE: '{{TagFor "base" "jdk" "jdk8"}}'
+`), &cfg)
+	require.NoError(t, err)
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	for _, parallelism := range []int{1, 4} {
+		var mu sync.Mutex
+		var pushed []string
+		executor := funcExecutor(func(w io.Writer, name string, args ...string) error {
+			if args[1] == "test/base:jdk8-t1" {
+				return fmt.Errorf("push failed")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			pushed = append(pushed, args[1])
+			return nil
+		})
+		executors := map[string]dockergen.Executor{"base": executor, "app": executor, "legacy": executor}
+
+		params := cfg.ToParams()
+		params.Parallelism = parallelism
+		params.KeepGoing = true
+		buf := &bytes.Buffer{}
+		err = dockergen.Push(executors, bParams, params, buf)
+		require.EqualError(t, err, "1 of 6 build iterations failed and 3 were skipped", "parallelism %d", parallelism)
+
+		// the units for jdk11 only depend on base for jdk8 if they reference its tag
+		assert.ElementsMatch(t, []string{"test/base:jdk11-t1", "test/app:jdk11-t1"}, pushed, "parallelism %d", parallelism)
+		assert.Contains(t, buf.String(), `
+BUILD   VARS         TAG                   STATUS
+base    {jdk=jdk8}   test/base:jdk8-t1     failed
+app     {jdk=jdk8}   test/app:jdk8-t1      skipped
+legacy  {jdk=jdk8}   test/legacy:jdk8-t1   skipped
+base    {jdk=jdk11}  test/base:jdk11-t1    succeeded
+app     {jdk=jdk11}  test/app:jdk11-t1     succeeded
+legacy  {jdk=jdk11}  test/legacy:jdk11-t1  skipped
+`, "parallelism %d", parallelism)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// DockerBuildOptions are the options that are passed to "docker build". All of the string values can use templates.
+type DockerBuildOptions struct {
+	// Build-time variables that are set using "--build-arg".
+	BuildArgs map[string]string `yaml:"build-args"`
+	// Metadata that is set on the image using "--label".
+	Labels map[string]string `yaml:"labels"`
+	// Build stage that is built using "--target".
+	Target string `yaml:"target"`
+	// Networking mode for RUN instructions that is set using "--network".
+	Network string `yaml:"network"`
+	// Platform for the build that is set using "--platform".
+	Platform string `yaml:"platform"`
+	// If true, the cache is not used when building the image ("--no-cache").
+	NoCache *bool `yaml:"no-cache"`
+	// If true, newer versions of the base images are always pulled ("--pull").
+	Pull *bool `yaml:"pull"`
+}
+
+// withDefaults returns options where the values that are not set in these options are set to the values in the
+// provided defaults. Build arguments and labels are merged, with the values in these options taking precedence.
+func (o DockerBuildOptions) withDefaults(defaults DockerBuildOptions) DockerBuildOptions {
+	merged := o
+	merged.BuildArgs = mergeStringMaps(defaults.BuildArgs, o.BuildArgs)
+	merged.Labels = mergeStringMaps(defaults.Labels, o.Labels)
+	if merged.Target == "" {
+		merged.Target = defaults.Target
+	}
+	if merged.Network == "" {
+		merged.Network = defaults.Network
+	}
+	if merged.Platform == "" {
+		merged.Platform = defaults.Platform
+	}
+	if merged.NoCache == nil {
+		merged.NoCache = defaults.NoCache
+	}
+	if merged.Pull == nil {
+		merged.Pull = defaults.Pull
+	}
+	return merged
+}
+
+// mergeStringMaps returns a map that contains all of the entries of the provided maps. If a key is present in multiple
+// maps, the value in the last map is used. Returns nil if all of the maps are empty.
+func mergeStringMaps(maps ...map[string]string) map[string]string {
+	var merged map[string]string
+	for _, m := range maps {
+		for k, v := range m {
+			if merged == nil {
+				merged = make(map[string]string)
+			}
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// render returns options in which all of the string values are rendered using the provided function.
+func (o DockerBuildOptions) render(renderFn func(string) (string, error)) (DockerBuildOptions, error) {
+	rendered := o
+	var err error
+	if rendered.BuildArgs, err = renderStringMap(o.BuildArgs, renderFn); err != nil {
+		return DockerBuildOptions{}, errors.Wrapf(err, "failed to execute template for build-args")
+	}
+	if rendered.Labels, err = renderStringMap(o.Labels, renderFn); err != nil {
+		return DockerBuildOptions{}, errors.Wrapf(err, "failed to execute template for labels")
+	}
+	for _, field := range []struct {
+		name string
+		val  *string
+	}{
+		{"target", &rendered.Target},
+		{"network", &rendered.Network},
+		{"platform", &rendered.Platform},
+	} {
+		if *field.val, err = renderFn(*field.val); err != nil {
+			return DockerBuildOptions{}, errors.Wrapf(err, "failed to execute template for %s", field.name)
+		}
+	}
+	return rendered, nil
+}
+
+func renderStringMap(in map[string]string, renderFn func(string) (string, error)) (map[string]string, error) {
+	if in == nil {
+		return nil, nil
+	}
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		rendered, err := renderFn(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "key %s", k)
+		}
+		out[k] = rendered
+	}
+	return out, nil
+}
+
+// args returns the "docker build" arguments for the options. Build arguments and labels are sorted by key.
+func (o DockerBuildOptions) args() []string {
+	var args []string
+	for _, k := range sortedKeys(o.BuildArgs) {
+		args = append(args, "--build-arg", k+"="+o.BuildArgs[k])
+	}
+	for _, k := range sortedKeys(o.Labels) {
+		args = append(args, "--label", k+"="+o.Labels[k])
+	}
+	if o.Target != "" {
+		args = append(args, "--target", o.Target)
+	}
+	if o.Network != "" {
+		args = append(args, "--network", o.Network)
+	}
+	if o.Platform != "" {
+		args = append(args, "--platform", o.Platform)
+	}
+	if o.NoCache != nil && *o.NoCache {
+		args = append(args, "--no-cache")
+	}
+	if o.Pull != nil && *o.Pull {
+		args = append(args, "--pull")
+	}
+	return args
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
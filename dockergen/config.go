@@ -6,6 +6,7 @@ package dockergen
 
 import (
 	"fmt"
+	"path/filepath"
 	"sort"
 	"strings"
 
@@ -25,32 +26,110 @@ type Config struct {
 	// key of the map will be the name of the template variable and the value will be the value for the current
 	// iteration.
 	For map[string][]string `yaml:"for"`
+	// If present, specifies variables whose values are combined as a cartesian product and looped over for all
+	// generation tasks. Cannot be specified if "for" is specified.
+	Matrix *Matrix `yaml:"matrix"`
+	// Default options for "docker build" for all of the build tasks. Options specified for a build task take precedence.
+	DockerBuildOptions `yaml:",inline"`
+	// Default options for retrying failed docker commands for all of the build tasks. Options specified for a build task
+	// take precedence.
+	RetryOptions `yaml:",inline"`
 	// All of the build tasks defined for this configuration.
 	Builds BuildYMLs `yaml:"builds"`
+	// If true, relative paths in the configuration are resolved relative to the working directory rather than Dir.
+	PathsRelativeToWorkingDir bool `yaml:"paths-relative-to-working-dir"`
+	// Paths or glob patterns of other configuration files whose builds, template variables and "for" variables are
+	// merged into this configuration. Relative paths are resolved like the other relative paths in the configuration.
+	// Includes are resolved by LoadConfig.
+	Include []string `yaml:"include"`
+	// Named sets of overrides for the configuration. A profile is applied using WithProfile.
+	Profiles map[string]Profile `yaml:"profiles"`
+	// Paths or glob patterns of template files that define partials: named templates that all of the other templates
+	// can invoke using {{template "name" .}}. The name of a partial is the name of its file without the extension.
+	// Relative paths are resolved like the other relative paths in the configuration.
+	Partials []string `yaml:"partials"`
+
+	// Directory relative to which relative paths in the configuration are resolved. Typically the directory that
+	// contains the configuration file. If empty, relative paths are resolved relative to the working directory.
+	Dir string `yaml:"-"`
+
+	// patterns of the partials of included configuration files, which are resolved relative to the directories of those
+	// files
+	includedPartials []string
 }
 
-type BuildYMLs yaml.MapSlice // sorted map[string]BuildConfig
+// LoadConfig reads the configuration file at the provided path and sets the directory of the returned configuration to
+// the directory that contains the file. The files that the configuration includes are loaded and merged into it. The
+// files are decoded strictly: keys that do not correspond to a configuration field and duplicate keys are errors. If a
+// file cannot be decoded or the included files conflict, the returned error is a *ConfigError that describes all of the
+// problems along with their positions.
+func LoadConfig(path string) (Config, error) {
+	files, err := loadConfigFiles(path, true)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg, verrs := mergeConfigFiles(files)
+	if len(verrs) != 0 {
+		return Config{}, &ConfigError{
+			Path:   path,
+			Errors: verrs,
+		}
+	}
+	return cfg, nil
+}
 
-func (s *BuildYMLs) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	var mapSlice yaml.MapSlice
-	if err := unmarshal(&mapSlice); err != nil {
-		return err
+// ConfigError is returned by LoadConfig when a configuration file cannot be decoded or included files conflict.
+type ConfigError struct {
+	// Path of the configuration file. Problems that do not specify a file occur in this file.
+	Path string
+	// Problems in the configuration file.
+	Errors []ValidationError
+}
+
+// Error returns the problems in the configuration file, one per line, in the form "path:line:column: message".
+func (e *ConfigError) Error() string {
+	var lines []string
+	for _, verr := range e.Errors {
+		path := e.Path
+		if verr.File != "" {
+			path = verr.File
+		}
+		lines = append(lines, verr.format(path))
 	}
+	return strings.Join(lines, "\n")
+}
 
-	// values of MapSlice are known to be BuildConfig, so read them out as such
-	for i, v := range mapSlice {
-		bytes, err := yaml.Marshal(v.Value)
-		if err != nil {
-			return err
+type BuildYMLs yaml.MapSlice // sorted map[string]BuildConfig
+
+func (s *BuildYMLs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// this form of UnmarshalYAML is called by both yaml.v2 and yaml.v3. Decode the builds as a map so that they are
+	// decoded by the same decoder as the rest of the configuration (which preserves the strictness and line numbers of
+	// the decoder and collects the problems of all of the builds) and determine their order from the keys of the map.
+	// The keys are determined first because yaml.v3 reuses the storage of the problems returned by unmarshal for the
+	// problems of subsequent calls. The builds that could be decoded are kept if there are problems so that the rest of
+	// the configuration can still be validated.
+	names, keysErr := mapKeys(unmarshal)
+	var builds map[string]BuildConfig
+	decodeErr := unmarshal(&builds)
+	if keysErr != nil {
+		if decodeErr != nil {
+			return decodeErr
 		}
-		var currBuildConfig BuildConfig
-		if err := yaml.Unmarshal(bytes, &currBuildConfig); err != nil {
-			return err
+		return keysErr
+	}
+	var mapSlice BuildYMLs
+	for _, name := range names {
+		build, ok := builds[name]
+		if !ok {
+			continue
 		}
-		mapSlice[i].Value = currBuildConfig
+		mapSlice = append(mapSlice, yaml.MapItem{
+			Key:   name,
+			Value: build,
+		})
 	}
-	*s = BuildYMLs(mapSlice)
-	return nil
+	*s = mapSlice
+	return decodeErr
 }
 
 func (c *Config) ToParams() Params {
@@ -59,7 +138,37 @@ func (c *Config) ToParams() Params {
 		TemplateVars: c.TemplateVars,
 		TagSuffix:    c.TagSuffix,
 		For:          c.For,
+		Matrix:       c.Matrix,
+		Dir:          c.baseDir(),
+		Partials:     c.partialPatterns(),
+	}
+}
+
+// partialPatterns returns the patterns of the partials of the configuration resolved relative to the base directory
+// followed by the patterns of the partials of the included configuration files.
+func (c *Config) partialPatterns() []string {
+	var patterns []string
+	for _, pattern := range c.Partials {
+		patterns = append(patterns, resolvePath(c.baseDir(), pattern))
+	}
+	return append(patterns, c.includedPartials...)
+}
+
+// baseDir returns the directory relative to which relative paths in the configuration are resolved. Returns an empty
+// string if relative paths should be resolved relative to the working directory.
+func (c *Config) baseDir() string {
+	if c.PathsRelativeToWorkingDir {
+		return ""
 	}
+	return c.Dir
+}
+
+// buildDir returns the directory relative to which the relative paths of the provided build are resolved.
+func (c *Config) buildDir(build BuildConfig) string {
+	if build.dir != nil {
+		return *build.dir
+	}
+	return c.baseDir()
 }
 
 func (c *Config) BuildParams() ([]BuildParams, error) {
@@ -69,12 +178,28 @@ func (c *Config) BuildParams() ([]BuildParams, error) {
 	var params []BuildParams
 	for _, v := range c.Builds {
 		val := v.Value.(BuildConfig)
+		dir := c.buildDir(val)
 		currParam := BuildParams{
-			Name:                   v.Key.(string),
-			DockerfileTemplatePath: val.DockerTemplatePath,
-			Tag:                    val.Tag,
-			For:                    val.For,
-			Requires:               val.Requires,
+			Name:                     v.Key.(string),
+			Dir:                      dir,
+			DockerfileTemplatePath:   resolvePath(dir, val.DockerTemplatePath),
+			Tag:                      val.Tag,
+			Tags:                     val.Tags,
+			Aliases:                  val.Aliases,
+			Context:                  val.Context,
+			DockerignoreTemplatePath: resolvePath(dir, val.DockerignoreTemplatePath),
+			RenderFiles:              val.RenderFiles,
+			For:                      val.For,
+			Matrix:                   val.Matrix,
+			Requires:                 val.Requires,
+			BuildOptions:             val.DockerBuildOptions.withDefaults(c.DockerBuildOptions),
+			Retry:                    val.RetryOptions.withDefaults(c.RetryOptions),
+		}
+		if err := validateLoop(currParam.For, currParam.Matrix); err != nil {
+			return nil, errors.Wrapf(err, "Invalid configuration for image %s", currParam.Name)
+		}
+		if err := validateForLengths(currParam.For, "'for'"); err != nil {
+			return nil, errors.Wrapf(err, "Invalid configuration for image %s", currParam.Name)
 		}
 		params = append(params, currParam)
 		currFirstLevelDeps := make(map[string]struct{})
@@ -117,22 +242,78 @@ func verifyNoCycles(key string, path []string, firstLevelDepsMap map[string][]st
 	return nil
 }
 
+// validateLoop returns an error if both "for" variables and a matrix are specified or if the matrix is invalid.
+func validateLoop(forVars map[string][]string, matrix *Matrix) error {
+	if matrix == nil {
+		return nil
+	}
+	if len(forVars) != 0 {
+		return errors.Errorf("'for' and 'matrix' cannot both be specified")
+	}
+	if err := matrix.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid 'matrix'")
+	}
+	return nil
+}
+
 type Params struct {
 	BuildIDVar   string
 	TemplateVars map[string]string
 	TagSuffix    string
 	For          map[string][]string
+	Matrix       *Matrix
+	// Maximum number of builds that are run concurrently. Builds are only run concurrently with builds that they do not
+	// require. If less than 2, builds are run sequentially.
+	Parallelism int
+	// If non-empty, the path to which a JSON manifest of the images that were built or pushed is written.
+	ManifestPath string
+	// If non-empty, the path to the state file used for incremental builds. The build action skips an image whose
+	// inputs (the rendered Dockerfile, build options, build context and the inputs of the images it requires) are
+	// unchanged since the build recorded in the state file and tags the previously built image instead.
+	StateFile string
+	// If non-nil, receives an event when the action for each build iteration starts and finishes.
+	Listener Listener
+	// If true, the builds that do not depend on a failed build are still run after a build fails, the builds that depend
+	// on a failed build are skipped and a summary of the outcome of every build is written at the end of the run. An
+	// error is returned if any build failed.
+	KeepGoing bool
+	// Options for retrying failed docker commands that take precedence over the options of every build.
+	Retry RetryOptions
+	// Paths or glob patterns of the template files that define the partials that are available to all of the
+	// templates. Relative paths are resolved relative to the working directory.
+	Partials []string
+	// Directory relative to which relative paths that are read by the templates of the template variables and the
+	// outer "for" variables are resolved. If empty, they are resolved relative to the working directory. The templates
+	// of a build resolve relative paths relative to the directory of the build.
+	Dir string
+	// If non-empty, only the build iterations that match are run. Keys are the names of "for" or "matrix" variables
+	// and values are glob patterns in the syntax of path.Match. An iteration matches if, for every key, it has the
+	// variable and the value of the variable matches any of the patterns. The iterations whose tags the templates of
+	// matching iterations reference (directly or transitively) are also run. The tags of all of the iterations are still
+	// computed, so the "Tag" and "TagFor" template functions return the same tags as they would if all of the iterations
+	// were run.
+	Where map[string][]string
+	// If non-nil, the executor used for the iterations that are only run because the templates of iterations that match
+	// Where reference their tags.
+	DependencyExecutor Executor
 }
 
 func (p *Params) Validate() error {
-	if len(p.For) == 0 {
+	if err := validateLoop(p.For, p.Matrix); err != nil {
+		return err
+	}
+	if err := validateWhere(p.Where); err != nil {
+		return err
+	}
+	if len(p.For) == 0 && p.Matrix == nil {
 		return nil
 	}
 
 	// fail if any template vars and for vars collide
+	loopVars := newLoop(p.For, p.Matrix)
 	var duplicateVars []string
 	for k := range p.TemplateVars {
-		if _, ok := p.For[k]; !ok {
+		if !loopVars.hasVar(k) {
 			continue
 		}
 		duplicateVars = append(duplicateVars, k)
@@ -142,25 +323,26 @@ func (p *Params) Validate() error {
 		return fmt.Errorf("the following variables were defined as both template and for variables: %v", duplicateVars)
 	}
 
-	var sortedForVarNames []string
-	for k := range p.For {
-		sortedForVarNames = append(sortedForVarNames, k)
-	}
-	sort.Strings(sortedForVarNames)
+	return validateForLengths(p.For, "outer 'for'")
+}
+
+// validateForLengths returns an error if the value arrays of the provided "for" variables do not all have the same
+// length. The description of the variables is used in the error message.
+func validateForLengths(forVars map[string][]string, description string) error {
+	sortedForVarNames := sortedForVarNames(forVars)
 
-	// verify all "For" variables are of the same length
 	forVarLen := -1
 	for _, varName := range sortedForVarNames {
-		vals := p.For[varName]
+		vals := forVars[varName]
 		if forVarLen == -1 {
 			forVarLen = len(vals)
 			continue
 		}
 		if len(vals) != forVarLen {
 			var parts []string
-			parts = append(parts, "Length of all outer 'for' variable arrays must be the same:")
+			parts = append(parts, fmt.Sprintf("Length of all %s variable arrays must be the same:", description))
 			for _, varName := range sortedForVarNames {
-				parts = append(parts, fmt.Sprintf("%s: %d", varName, len(p.For[varName])))
+				parts = append(parts, fmt.Sprintf("%s: %d", varName, len(forVars[varName])))
 			}
 			return fmt.Errorf(strings.Join(parts, "\n\t"))
 		}
@@ -173,20 +355,69 @@ type BuildConfig struct {
 	DockerTemplatePath string `yaml:"docker-template"`
 	// Tag that will be used for the generated image. Can use templates.
 	Tag string `yaml:"tag"`
+	// Additional tags that will be used for the generated image. Can use templates. The tag suffix is appended to each
+	// tag. If "tag" is not specified, the first of these tags is the primary tag of the image.
+	Tags []string `yaml:"tags"`
+	// Tags that will be used for the generated image as-is (the tag suffix is not appended). Can use templates. Useful
+	// for floating tags such as "latest".
+	Aliases []string `yaml:"aliases"`
+	// Build context directory. Can use templates. If empty, the directory that contains the Dockerfile template is
+	// used.
+	Context string `yaml:"context"`
+	// Path to a template for the .dockerignore file of the build context. The template is rendered with the same
+	// variables as the Dockerfile template. If specified, the build uses a staged copy of the build context that
+	// contains the rendered .dockerignore (which replaces the .dockerignore of the build context directory, if any).
+	DockerignoreTemplatePath string `yaml:"dockerignore-template"`
+	// Glob patterns for files in the build context that are rendered as templates with the same variables as the
+	// Dockerfile template. Patterns are resolved relative to the build context directory. If specified, the build uses
+	// a staged copy of the build context in which the matching files are replaced with their rendered content.
+	RenderFiles []string `yaml:"render-files"`
 	// If present, specifies variables that will be looped over for this generation task. If more than one key is
 	// specified, all of the value slices must have the same length. During any single iteration, the name of the
 	// key of the map will be the name of the template variable and the value will be the value for the current
 	// iteration.
 	For map[string][]string `yaml:"for"`
+	// If present, specifies variables whose values are combined as a cartesian product and looped over for this
+	// generation task. Cannot be specified if "for" is specified.
+	Matrix *Matrix `yaml:"matrix"`
 	// Requires specifies the build configurations that must be built before this build configuration is built. Cannot
 	// contain cycles.
 	Requires []string `yaml:"requires"`
+	// Options for "docker build" for this build task.
+	DockerBuildOptions `yaml:",inline"`
+	// Options for retrying failed docker commands for this build task.
+	RetryOptions `yaml:",inline"`
+
+	// if non-nil, the directory relative to which relative paths of the build are resolved. Set for builds that are
+	// included from other configuration files.
+	dir *string
+}
+
+// resolvePath returns the provided path resolved relative to the provided directory. If the path is empty or absolute or
+// the directory is empty, the path is returned unmodified.
+func resolvePath(dir, path string) string {
+	if dir == "" || path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
 }
 
 type BuildParams struct {
-	Name                   string
-	DockerfileTemplatePath string
-	Tag                    string
-	For                    map[string][]string
-	Requires               []string
+	Name string
+	// Directory relative to which relative paths for the build are resolved. If empty, relative paths are resolved
+	// relative to the working directory. DockerfileTemplatePath and DockerignoreTemplatePath are resolved by
+	// Config.BuildParams, while paths that can use templates are resolved after they are rendered.
+	Dir                      string
+	DockerfileTemplatePath   string
+	Tag                      string
+	Tags                     []string
+	Aliases                  []string
+	Context                  string
+	DockerignoreTemplatePath string
+	RenderFiles              []string
+	For                      map[string][]string
+	Matrix                   *Matrix
+	Requires                 []string
+	BuildOptions             DockerBuildOptions
+	Retry                    RetryOptions
 }
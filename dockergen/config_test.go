@@ -6,12 +6,16 @@ package dockergen_test
 
 import (
 	"fmt"
+	"io/ioutil"
+	"path"
 	"testing"
 
 	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
 )
 
 func TestLoadConfigWithCycles(t *testing.T) {
@@ -86,3 +90,218 @@ builds:
 		assert.Regexp(t, tc.wantError, err.Error(), "Case %d: %s", i, tc.name)
 	}
 }
+
+func TestBuildParamsResolvesRelativePaths(t *testing.T) {
+	for i, tc := range []struct {
+		name                   string
+		yml                    string
+		wantDir                string
+		wantDockerfileTemplate string
+		wantDockerignore       string
+	}{
+		{
+			"relative paths are resolved relative to config directory",
+			`
+builds:
+  foo:
+    docker-template: foo/Dockerfile_template.txt
+    dockerignore-template: foo/dockerignore.txt
+`,
+			"config/dir",
+			"config/dir/foo/Dockerfile_template.txt",
+			"config/dir/foo/dockerignore.txt",
+		},
+		{
+			"absolute paths are not modified",
+			`
+builds:
+  foo:
+    docker-template: /foo/Dockerfile_template.txt
+`,
+			"config/dir",
+			"/foo/Dockerfile_template.txt",
+			"",
+		},
+		{
+			"paths are relative to working directory if specified",
+			`
+paths-relative-to-working-dir: true
+builds:
+  foo:
+    docker-template: foo/Dockerfile_template.txt
+    dockerignore-template: foo/dockerignore.txt
+`,
+			"",
+			"foo/Dockerfile_template.txt",
+			"foo/dockerignore.txt",
+		},
+	} {
+		var cfg dockergen.Config
+		err := yaml.Unmarshal([]byte(tc.yml), &cfg)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		cfg.Dir = "config/dir"
+
+		bParams, err := cfg.BuildParams()
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		require.Equal(t, 1, len(bParams), "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.wantDir, bParams[0].Dir, "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.wantDockerfileTemplate, bParams[0].DockerfileTemplatePath, "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.wantDockerignore, bParams[0].DockerignoreTemplatePath, "Case %d: %s", i, tc.name)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+	cfgPath := path.Join(tmpDir, "dockergen.yml")
+
+	for i, tc := range []struct {
+		name       string
+		yml        string
+		wantBuilds []string
+		wantError  string
+	}{
+		{
+			"valid configuration preserves order of builds",
+			`builds:
+  foo:
+    docker-template: foo/Dockerfile_template.txt
+    tag: test/foo
+  bar:
+    docker-template: bar/Dockerfile_template.txt
+    tag: test/bar
+    retry-backoff: 1s
+`,
+			[]string{"foo", "bar"},
+			"",
+		},
+		{
+			"keys whose values define anchors and merge keys are valid",
+			`x-defaults: &defaults
+  docker-template: Dockerfile_template.txt
+  retry-backoff: 1s
+builds:
+  foo:
+    <<: *defaults
+    tag: test/foo
+  bar:
+    <<: *defaults
+    tag: test/bar
+`,
+			[]string{"foo", "bar"},
+			"",
+		},
+		{
+			"unknown keys and type errors are reported with their positions",
+			`tag-sufix: -t1
+builds:
+  foo:
+    docker-templte: foo/Dockerfile_template.txt
+    tag: test/foo
+    requires: bar
+`,
+			nil,
+			cfgPath + ":1:1: unknown key \"tag-sufix\"\n" +
+				cfgPath + ":4:5: unknown key \"builds.foo.docker-templte\"\n" +
+				cfgPath + ":6:15: cannot unmarshal !!str `bar` into []string",
+		},
+		{
+			"duplicate keys are reported with their positions",
+			`builds:
+  foo:
+    tag: test/foo
+  foo:
+    tag: test/foo2
+`,
+			nil,
+			cfgPath + `:4:3: mapping key "foo" already defined at line 2`,
+		},
+		{
+			"problems in matrices are reported with their positions",
+			`builds:
+  foo:
+    tag: test/foo
+    matrix:
+      jdk: jdk8
+      include:
+        - jdk11
+`,
+			nil,
+			cfgPath + ":5:12: cannot unmarshal !!str `jdk8` into []string\n" +
+				cfgPath + ":7:11: cannot unmarshal !!str `jdk11` into map[string]string",
+		},
+		{
+			"syntax errors are reported with the line reported by the parser",
+			`builds:
+  foo:
+    tag: test/foo
+   bar: baz
+`,
+			nil,
+			cfgPath + ":1: did not find expected key",
+		},
+	} {
+		require.NoError(t, ioutil.WriteFile(cfgPath, []byte(tc.yml), 0644), "Case %d: %s", i, tc.name)
+
+		cfg, err := dockergen.LoadConfig(cfgPath)
+		if tc.wantError != "" {
+			require.Error(t, err, fmt.Sprintf("Case %d: %s", i, tc.name))
+			assert.Equal(t, tc.wantError, err.Error(), "Case %d: %s", i, tc.name)
+			continue
+		}
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		assert.Equal(t, tmpDir, cfg.Dir, "Case %d: %s", i, tc.name)
+		var gotBuilds []string
+		for _, item := range cfg.Builds {
+			gotBuilds = append(gotBuilds, item.Key.(string))
+		}
+		assert.Equal(t, tc.wantBuilds, gotBuilds, "Case %d: %s", i, tc.name)
+	}
+}
+
+func TestUnmarshalConfig(t *testing.T) {
+	yml := `
+builds:
+  foo:
+    docker-template: foo/Dockerfile_template.txt
+    tag: test/foo:{{.jdk}}
+    matrix:
+      jdk:
+        - jdk8
+        - jdk11
+      exclude:
+        - jdk: jdk11
+  bar:
+    docker-template: bar/Dockerfile_template.txt
+    tag: test/bar
+    requires:
+      - foo
+`
+	for i, tc := range []struct {
+		name      string
+		unmarshal func([]byte, interface{}) error
+	}{
+		{"yaml.v2", yaml.Unmarshal},
+		{"yaml.v3", yamlv3.Unmarshal},
+	} {
+		var cfg dockergen.Config
+		err := tc.unmarshal([]byte(yml), &cfg)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		bParams, err := cfg.BuildParams()
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		require.Equal(t, 2, len(bParams), "Case %d: %s", i, tc.name)
+		assert.Equal(t, "foo", bParams[0].Name, "Case %d: %s", i, tc.name)
+		assert.Equal(t, &dockergen.Matrix{
+			Vars: map[string][]string{
+				"jdk": {"jdk8", "jdk11"},
+			},
+			Exclude: []map[string]string{
+				{"jdk": "jdk11"},
+			},
+		}, bParams[0].Matrix, "Case %d: %s", i, tc.name)
+		assert.Equal(t, "bar", bParams[1].Name, "Case %d: %s", i, tc.name)
+		assert.Equal(t, []string{"foo"}, bParams[1].Requires, "Case %d: %s", i, tc.name)
+	}
+}
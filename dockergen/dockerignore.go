@@ -0,0 +1,172 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const dockerignoreFileName = ".dockerignore"
+
+// dockerignore matches paths against the patterns in a .dockerignore file using the same semantics as Docker: a path is
+// excluded if the last pattern that matches the path or any of its parent directories is not an exception ("!")
+// pattern.
+type dockerignore struct {
+	patterns      []ignorePattern
+	hasExceptions bool
+}
+
+type ignorePattern struct {
+	regexp    *regexp.Regexp
+	exception bool
+}
+
+// readDockerignore reads the .dockerignore file in the provided context directory. If the file does not exist, returns
+// a dockerignore that does not exclude any paths.
+func readDockerignore(contextDir string) (*dockerignore, error) {
+	f, err := os.Open(filepath.Join(contextDir, dockerignoreFileName))
+	if os.IsNotExist(err) {
+		return &dockerignore{}, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", dockerignoreFileName)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return parseDockerignore(f)
+}
+
+func parseDockerignore(r io.Reader) (*dockerignore, error) {
+	ignore := &dockerignore{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		exception := false
+		if strings.HasPrefix(line, "!") {
+			exception = true
+			line = strings.TrimSpace(line[1:])
+		}
+		line = strings.TrimPrefix(path.Clean(filepath.ToSlash(line)), "/")
+		if line == "" || line == "." {
+			continue
+		}
+		re, err := ignorePatternRegexp(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s pattern %s", dockerignoreFileName, line)
+		}
+		ignore.patterns = append(ignore.patterns, ignorePattern{
+			regexp:    re,
+			exception: exception,
+		})
+		ignore.hasExceptions = ignore.hasExceptions || exception
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", dockerignoreFileName)
+	}
+	return ignore, nil
+}
+
+// ignorePatternRegexp converts a .dockerignore pattern into a regular expression. "**" matches any number of
+// directories, "*" matches any sequence of non-separator characters and "?" matches a single non-separator character.
+func ignorePatternRegexp(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			i++
+			if i+1 < len(pattern) && pattern[i+1] == '/' {
+				// "**/" matches zero or more directories
+				i++
+				sb.WriteString("(.*/)?")
+			} else {
+				sb.WriteString(".*")
+			}
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end == -1 {
+				return nil, errors.Errorf("unterminated character class")
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// excluded returns true if the provided slash-separated path relative to the context directory is excluded.
+func (d *dockerignore) excluded(relPath string) bool {
+	excluded := false
+	for _, pattern := range d.patterns {
+		if pattern.matches(relPath) {
+			excluded = !pattern.exception
+		}
+	}
+	return excluded
+}
+
+// matches returns true if the pattern matches the provided path or any of its parent directories.
+func (p ignorePattern) matches(relPath string) bool {
+	for curr := relPath; curr != "." && curr != "/"; curr = path.Dir(curr) {
+		if p.regexp.MatchString(curr) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkContext calls the provided function for every file and directory in the provided context directory that is not
+// excluded by the provided dockerignore. The function is called with the slash-separated path relative to the context
+// directory. The .dockerignore file itself and any paths in alwaysInclude are never excluded.
+func walkContext(contextDir string, ignore *dockerignore, alwaysInclude map[string]struct{}, walkFn func(relPath, absPath string, info os.FileInfo) error) error {
+	return filepath.Walk(contextDir, func(absPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(contextDir, absPath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		_, include := alwaysInclude[rel]
+		if !include && rel != dockerignoreFileName && ignore.excluded(rel) {
+			// directories must still be walked if exceptions exist because an exception may include a file within it
+			if info.IsDir() && !ignore.hasExceptions {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return walkFn(rel, absPath, info)
+	})
+}
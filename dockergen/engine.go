@@ -0,0 +1,478 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultDockerSocket is the default path of the Unix socket on which the Docker Engine API is served.
+	DefaultDockerSocket = "/var/run/docker.sock"
+
+	// name of the Dockerfile in the build context sent to the engine when the Dockerfile is not in the context directory
+	contextDockerfileName = ".dockergen.Dockerfile"
+)
+
+// NewEngineExecutor returns an executor that runs "docker" commands by calling the Docker Engine HTTP API served on the
+// Unix socket at the provided path rather than running the docker CLI. The "build", "push" and "tag" commands with the
+// arguments generated by dockergen are supported. Output is written as it is streamed from the engine and errors
+// reported by the engine are returned as errors.
+func NewEngineExecutor(socketPath string) Executor {
+	return &engineExecutor{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+type engineExecutor struct {
+	client *http.Client
+}
+
+// engineMessage is a message in the JSON stream returned by the build and push endpoints of the Docker Engine API.
+type engineMessage struct {
+	Stream      string          `json:"stream"`
+	Status      string          `json:"status"`
+	Progress    string          `json:"progress"`
+	ID          string          `json:"id"`
+	Error       string          `json:"error"`
+	ErrorDetail *engineError    `json:"errorDetail"`
+	Aux         json.RawMessage `json:"aux"`
+}
+
+type engineError struct {
+	Message string `json:"message"`
+}
+
+func (e *engineExecutor) Run(w io.Writer, name string, args ...string) error {
+	return e.RunContext(context.Background(), Cmd{
+		Name:   name,
+		Args:   args,
+		Stdout: w,
+	})
+}
+
+// RunContext runs the provided docker command using the Docker Engine API. The output streamed from the engine is
+// written to the standard output writer of the command. Relative paths in the arguments are resolved relative to the
+// working directory of the command. The environment and standard input of the command are ignored. If the context is
+// done, the request to the engine is canceled.
+func (e *engineExecutor) RunContext(ctx context.Context, cmd Cmd) error {
+	name, args := cmd.Name, cmd.Args
+	if name != "docker" || len(args) == 0 {
+		return errors.Errorf("engine executor only supports docker commands: %s %v", name, args)
+	}
+	w := cmd.Stdout
+	if w == nil {
+		w = ioutil.Discard
+	}
+	switch args[0] {
+	case "build":
+		return e.build(ctx, w, cmd.Dir, args[1:])
+	case "push":
+		if len(args) != 2 {
+			return errors.Errorf("push requires exactly 1 argument: %v", args[1:])
+		}
+		return e.push(ctx, w, args[1])
+	case "tag":
+		if len(args) != 3 {
+			return errors.Errorf("tag requires exactly 2 arguments: %v", args[1:])
+		}
+		return e.tag(ctx, args[1], args[2])
+	default:
+		return errors.Errorf("engine executor does not support docker command %s", args[0])
+	}
+}
+
+func (e *engineExecutor) build(ctx context.Context, w io.Writer, dir string, args []string) error {
+	query := url.Values{}
+	var dockerfilePath, contextDir string
+	buildArgs := make(map[string]string)
+	labels := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "--no-cache":
+			query.Set("nocache", "1")
+			continue
+		case "--pull":
+			query.Set("pull", "1")
+			continue
+		case "-t", "-f", "--build-arg", "--label", "--target", "--network", "--platform":
+		default:
+			if strings.HasPrefix(arg, "-") || contextDir != "" {
+				return errors.Errorf("unsupported build argument %s", arg)
+			}
+			contextDir = resolvePath(dir, arg)
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return errors.Errorf("flag %s requires a value", arg)
+		}
+		i++
+		val := args[i]
+		switch arg {
+		case "-t":
+			query.Add("t", val)
+		case "-f":
+			dockerfilePath = resolvePath(dir, val)
+		case "--build-arg", "--label":
+			parts := strings.SplitN(val, "=", 2)
+			if len(parts) != 2 {
+				return errors.Errorf("value for %s must be of the form key=value, was %s", arg, val)
+			}
+			if arg == "--build-arg" {
+				buildArgs[parts[0]] = parts[1]
+			} else {
+				labels[parts[0]] = parts[1]
+			}
+		case "--target":
+			query.Set("target", val)
+		case "--network":
+			query.Set("networkmode", val)
+		case "--platform":
+			query.Set("platform", val)
+		}
+	}
+	for param, vals := range map[string]map[string]string{
+		"buildargs": buildArgs,
+		"labels":    labels,
+	} {
+		if len(vals) == 0 {
+			continue
+		}
+		bytes, err := json.Marshal(vals)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		query.Set(param, string(bytes))
+	}
+	if contextDir == "" {
+		return errors.Errorf("build context directory must be specified")
+	}
+	if dockerfilePath == "" {
+		dockerfilePath = filepath.Join(contextDir, "Dockerfile")
+	}
+
+	dockerfileName, err := filepath.Rel(contextDir, dockerfilePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	dockerfileName = filepath.ToSlash(dockerfileName)
+	if strings.HasPrefix(dockerfileName, "../") {
+		// Dockerfile is outside of the context directory, so add it to the context under a known name
+		dockerfileName = contextDockerfileName
+	}
+	query.Set("dockerfile", dockerfileName)
+
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(writeContextTar(pw, contextDir, dockerfilePath, dockerfileName))
+	}()
+	defer func() {
+		_ = pr.Close()
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, "http://docker/build?"+query.Encode(), pr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+	return e.doStream(ctx, w, req)
+}
+
+func (e *engineExecutor) push(ctx context.Context, w io.Writer, ref string) error {
+	repo, tag, isDigest := splitImageRef(ref)
+	if isDigest {
+		return errors.Errorf("cannot push digest reference %s: a tag is required", ref)
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://docker/images/%s/push?%s", url.PathEscape(repo), url.Values{"tag": {tag}}.Encode()), nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	auth, err := registryAuth(repo)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Registry-Auth", auth)
+	return e.doStream(ctx, w, req)
+}
+
+func (e *engineExecutor) tag(ctx context.Context, source, target string) error {
+	repo, tag, isDigest := splitImageRef(target)
+	if isDigest {
+		return errors.Errorf("cannot tag an image with digest reference %s: a tag is required", target)
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://docker/images/%s/tag?%s", url.PathEscape(source), url.Values{"repo": {repo}, "tag": {tag}}.Encode()), nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := e.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (e *engineExecutor) InspectImage(w io.Writer, ref string) (ImageInfo, error) {
+	return e.InspectImageContext(context.Background(), w, ref)
+}
+
+// InspectImageContext inspects the image using the Docker Engine API. If the context is done, the request to the engine
+// is canceled.
+func (e *engineExecutor) InspectImageContext(ctx context.Context, w io.Writer, ref string) (ImageInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://docker/images/%s/json", url.PathEscape(ref)), nil)
+	if err != nil {
+		return ImageInfo{}, errors.WithStack(err)
+	}
+	resp, err := e.do(ctx, req)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var info ImageInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return ImageInfo{}, errors.Wrapf(err, "failed to decode response from Docker engine")
+	}
+	return info, nil
+}
+
+// do performs the provided request with the provided context and returns an error if the request fails or if the engine
+// returns a non-2xx response.
+func (e *engineExecutor) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "request to Docker engine failed")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		body, _ := ioutil.ReadAll(resp.Body)
+		var engineErr engineError
+		if err := json.Unmarshal(body, &engineErr); err != nil || engineErr.Message == "" {
+			engineErr.Message = strings.TrimSpace(string(body))
+		}
+		return nil, errors.Errorf("Docker engine returned %s: %s", resp.Status, engineErr.Message)
+	}
+	return resp, nil
+}
+
+// doStream performs the provided request and reads the response as a stream of JSON messages. The output of each
+// message is written to the provided writer. Returns an error if any of the messages is an error.
+func (e *engineExecutor) doStream(ctx context.Context, w io.Writer, req *http.Request) error {
+	resp, err := e.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg engineMessage
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to decode response from Docker engine")
+		}
+		if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+			return errors.New(msg.ErrorDetail.Message)
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		if msg.Stream != "" {
+			_, _ = io.WriteString(w, msg.Stream)
+		}
+		if msg.Status != "" {
+			line := msg.Status
+			if msg.ID != "" {
+				line = msg.ID + ": " + line
+			}
+			if msg.Progress != "" {
+				line += " " + msg.Progress
+			}
+			_, _ = fmt.Fprintln(w, line)
+		}
+		if len(msg.Aux) > 0 {
+			var aux struct {
+				ID string `json:"ID"`
+			}
+			if err := json.Unmarshal(msg.Aux, &aux); err == nil && aux.ID != "" {
+				_, _ = fmt.Fprintln(w, "Built image", aux.ID)
+			}
+		}
+	}
+}
+
+// writeContextTar writes a tar archive of the provided context directory to the provided writer. Paths excluded by the
+// .dockerignore file in the context directory are not included. The Dockerfile is always included under the provided
+// name.
+func writeContextTar(w io.Writer, contextDir, dockerfilePath, dockerfileName string) error {
+	ignore, err := readDockerignore(contextDir)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	alwaysInclude := map[string]struct{}{
+		dockerfileName: {},
+	}
+	if err := walkContext(contextDir, ignore, alwaysInclude, func(relPath, absPath string, info os.FileInfo) error {
+		return addTarEntry(tw, relPath, absPath, info)
+	}); err != nil {
+		return errors.Wrapf(err, "failed to create build context")
+	}
+	if dockerfileName == contextDockerfileName {
+		info, err := os.Stat(dockerfilePath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := addTarEntry(tw, dockerfileName, dockerfilePath, info); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addTarEntry(tw *tar.Writer, name, absPath string, info os.FileInfo) error {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(absPath); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.WithStack(err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(absPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err := io.Copy(tw, f); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// splitImageRef splits the provided image reference into its repository and its tag or digest. Returns true if the
+// reference is a digest reference of the form "repo@sha256:...", in which case a tag that precedes the digest is
+// dropped. If the reference specifies neither a tag nor a digest, the tag is "latest".
+func splitImageRef(ref string) (string, string, bool) {
+	if idx := strings.Index(ref, "@"); idx != -1 {
+		repo, _, _ := splitImageRef(ref[:idx])
+		return repo, ref[idx+1:], true
+	}
+	// a colon that is followed by a slash separates the port of the registry rather than the tag
+	if idx := strings.LastIndex(ref, ":"); idx != -1 && !strings.Contains(ref[idx+1:], "/") {
+		return ref[:idx], ref[idx+1:], false
+	}
+	return ref, "latest", false
+}
+
+// registryAuth returns the value of the X-Registry-Auth header for pushing to the registry of the provided repository.
+// Credentials are read from the "auths" section of the Docker CLI configuration file if present. Credential helpers
+// are not supported.
+func registryAuth(repo string) (string, error) {
+	type authConfig struct {
+		Username      string `json:"username,omitempty"`
+		Password      string `json:"password,omitempty"`
+		ServerAddress string `json:"serveraddress,omitempty"`
+	}
+	var auth authConfig
+	if creds, server, ok := dockerConfigCredentials(repo); ok {
+		if parts := strings.SplitN(creds, ":", 2); len(parts) == 2 {
+			auth = authConfig{
+				Username:      parts[0],
+				Password:      parts[1],
+				ServerAddress: server,
+			}
+		}
+	}
+	bytes, err := json.Marshal(auth)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return base64.URLEncoding.EncodeToString(bytes), nil
+}
+
+// dockerConfigCredentials returns the decoded "user:password" credentials for the registry of the provided repository
+// from the Docker CLI configuration file along with the server address for which they were configured.
+func dockerConfigCredentials(repo string) (string, string, bool) {
+	configDir := os.Getenv("DOCKER_CONFIG")
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", false
+		}
+		configDir = filepath.Join(home, ".docker")
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(configDir, "config.json"))
+	if err != nil {
+		return "", "", false
+	}
+	var dockerConfig struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(bytes, &dockerConfig); err != nil {
+		return "", "", false
+	}
+
+	registry := "https://index.docker.io/v1/"
+	if parts := strings.SplitN(repo, "/", 2); len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		registry = parts[0]
+	}
+	for server, entry := range dockerConfig.Auths {
+		if server != registry && strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://") != registry {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return "", "", false
+		}
+		return string(decoded), server, true
+	}
+	return "", "", false
+}
@@ -0,0 +1,276 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEngine is a fake Docker Engine API server. It records the requests that it receives and the names of the files
+// in the build contexts that it receives.
+type fakeEngine struct {
+	requests     []string
+	contextFiles []string
+	response     string
+	statusCode   int
+}
+
+func (e *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.requests = append(e.requests, r.Method+" "+r.URL.String())
+	if r.URL.Path == "/build" {
+		tr := tar.NewReader(r.Body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			e.contextFiles = append(e.contextFiles, hdr.Name)
+		}
+	}
+	if e.statusCode != 0 {
+		w.WriteHeader(e.statusCode)
+	}
+	_, _ = io.WriteString(w, e.response)
+}
+
+func startFakeEngine(t *testing.T, engine *fakeEngine) (string, func()) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	require.NoError(t, err)
+
+	socketPath := path.Join(tmpDir, "docker.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	server := &http.Server{Handler: engine}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	return socketPath, func() {
+		_ = server.Close()
+		cleanup()
+	}
+}
+
+func TestEngineExecutor(t *testing.T) {
+	contextDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+
+	for name, content := range map[string]string{
+		"Dockerfile12345": "FROM scratch\n",
+		"included.txt":    "included",
+		"ignored.txt":     "ignored",
+		"sub/ignored.log": "ignored",
+		"sub/kept.log":    "kept",
+		".dockerignore":   "ignored.txt\nsub/*.log\n!sub/kept.log\n",
+	} {
+		require.NoError(t, os.MkdirAll(path.Dir(path.Join(contextDir, name)), 0755))
+		require.NoError(t, ioutil.WriteFile(path.Join(contextDir, name), []byte(content), 0644))
+	}
+
+	for i, tc := range []struct {
+		name             string
+		args             []string
+		response         string
+		statusCode       int
+		wantRequests     []string
+		wantContextFiles []string
+		wantOutput       string
+		wantError        string
+	}{
+		{
+			"build sends context",
+			[]string{"build", "-t", "test/foo:bar", "-f", path.Join(contextDir, "Dockerfile12345"), contextDir},
+			`{"stream":"Step 1/1 : FROM scratch\n"}
+{"aux":{"ID":"sha256:abc"}}
+{"stream":"Successfully built abc\n"}
+`,
+			0,
+			[]string{
+				"POST /build?dockerfile=Dockerfile12345&t=test%2Ffoo%3Abar",
+			},
+			[]string{
+				".dockerignore",
+				"Dockerfile12345",
+				"included.txt",
+				"sub/",
+				"sub/kept.log",
+			},
+			"Step 1/1 : FROM scratch\nBuilt image sha256:abc\nSuccessfully built abc\n",
+			"",
+		},
+		{
+			"build sends options",
+			[]string{"build", "-t", "test/foo:bar", "-t", "test/foo:latest", "--build-arg", "A=1", "--label", "l=v", "--target", "release", "--network", "host", "--platform", "linux/amd64", "--no-cache", "--pull", "-f", path.Join(contextDir, "Dockerfile12345"), contextDir},
+			`{"stream":"Successfully built abc\n"}`,
+			0,
+			[]string{
+				"POST /build?buildargs=%7B%22A%22%3A%221%22%7D&dockerfile=Dockerfile12345&labels=%7B%22l%22%3A%22v%22%7D&networkmode=host&nocache=1&platform=linux%2Famd64&pull=1&t=test%2Ffoo%3Abar&t=test%2Ffoo%3Alatest&target=release",
+			},
+			[]string{
+				".dockerignore",
+				"Dockerfile12345",
+				"included.txt",
+				"sub/",
+				"sub/kept.log",
+			},
+			"Successfully built abc\n",
+			"",
+		},
+		{
+			"build error is returned",
+			[]string{"build", "-t", "test/foo:bar", "-f", path.Join(contextDir, "Dockerfile12345"), contextDir},
+			`{"stream":"Step 1/1 : FROM scratch\n"}
+{"error":"failed","errorDetail":{"message":"build failed"}}
+`,
+			0,
+			nil,
+			nil,
+			"Step 1/1 : FROM scratch\n",
+			"build failed",
+		},
+		{
+			"push writes status",
+			[]string{"push", "test/foo:bar"},
+			`{"status":"Pushing","id":"abc","progress":"[==>]"}
+{"status":"bar: digest: sha256:def size: 528"}
+`,
+			0,
+			[]string{
+				"POST /images/test%2Ffoo/push?tag=bar",
+			},
+			nil,
+			"abc: Pushing [==>]\nbar: digest: sha256:def size: 528\n",
+			"",
+		},
+		{
+			"non-2xx response is returned as error",
+			[]string{"push", "test/foo:bar"},
+			`{"message":"no such image"}`,
+			http.StatusNotFound,
+			nil,
+			nil,
+			"",
+			"Docker engine returned 404 Not Found: no such image",
+		},
+		{
+			"tag",
+			[]string{"tag", "test/foo:bar", "test/foo:latest"},
+			"",
+			http.StatusCreated,
+			[]string{
+				"POST /images/test%2Ffoo:bar/tag?repo=test%2Ffoo&tag=latest",
+			},
+			nil,
+			"",
+			"",
+		},
+		{
+			"push of repository on registry with port uses latest tag",
+			[]string{"push", "localhost:5000/test/foo"},
+			`{"status":"Pushed"}`,
+			0,
+			[]string{
+				"POST /images/localhost:5000%2Ftest%2Ffoo/push?tag=latest",
+			},
+			nil,
+			"Pushed\n",
+			"",
+		},
+		{
+			"tag of digest reference",
+			[]string{"tag", "test/foo:bar@sha256:abc", "test/foo:latest"},
+			"",
+			http.StatusCreated,
+			[]string{
+				"POST /images/test%2Ffoo:bar@sha256:abc/tag?repo=test%2Ffoo&tag=latest",
+			},
+			nil,
+			"",
+			"",
+		},
+		{
+			"push of digest reference is an error",
+			[]string{"push", "test/foo@sha256:abc"},
+			"",
+			0,
+			nil,
+			nil,
+			"",
+			"cannot push digest reference test/foo@sha256:abc: a tag is required",
+		},
+		{
+			"tag with digest reference is an error",
+			[]string{"tag", "test/foo:bar", "test/foo@sha256:abc"},
+			"",
+			0,
+			nil,
+			nil,
+			"",
+			"cannot tag an image with digest reference test/foo@sha256:abc: a tag is required",
+		},
+	} {
+		engine := &fakeEngine{
+			response:   tc.response,
+			statusCode: tc.statusCode,
+		}
+		socketPath, stop := startFakeEngine(t, engine)
+
+		buf := &bytes.Buffer{}
+		err := dockergen.NewEngineExecutor(socketPath).Run(buf, "docker", tc.args...)
+		stop()
+
+		if tc.wantError != "" {
+			require.Error(t, err, fmt.Sprintf("Case %d: %s", i, tc.name))
+			assert.Regexp(t, tc.wantError, err.Error(), "Case %d: %s", i, tc.name)
+		} else {
+			require.NoError(t, err, "Case %d: %s", i, tc.name)
+			assert.Equal(t, tc.wantRequests, engine.requests, "Case %d: %s", i, tc.name)
+			sort.Strings(engine.contextFiles)
+			assert.Equal(t, tc.wantContextFiles, engine.contextFiles, "Case %d: %s", i, tc.name)
+		}
+		assert.Equal(t, tc.wantOutput, buf.String(), "Case %d: %s", i, tc.name)
+	}
+}
+
+func TestEngineExecutorInspectImageContext(t *testing.T) {
+	engine := &fakeEngine{
+		response: `{"Id":"sha256:abc","RepoDigests":["test/foo@sha256:def"]}`,
+	}
+	socketPath, stop := startFakeEngine(t, engine)
+	defer stop()
+	inspector := dockergen.NewEngineExecutor(socketPath).(dockergen.ContextImageInspector)
+
+	info, err := inspector.InspectImageContext(context.Background(), ioutil.Discard, "test/foo:bar")
+	require.NoError(t, err)
+	assert.Equal(t, dockergen.ImageInfo{ID: "sha256:abc", RepoDigests: []string{"test/foo@sha256:def"}}, info)
+	assert.Equal(t, []string{"GET /images/test%2Ffoo:bar/json"}, engine.requests)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = inspector.InspectImageContext(ctx, ioutil.Discard, "test/foo:bar")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "context canceled")
+	assert.Equal(t, 1, len(engine.requests))
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// EventType is the type of an Event.
+type EventType string
+
+const (
+	// EventStarted is emitted when the action for a single build iteration is started.
+	EventStarted EventType = "started"
+	// EventFinished is emitted when the action for a single build iteration completes, whether or not it succeeded.
+	EventFinished EventType = "finished"
+	// EventSkipped is emitted when the action for a single build iteration is not run because a build iteration that it
+	// depends on failed or was skipped. Only emitted for runs that keep going after a failure.
+	EventSkipped EventType = "skipped"
+)
+
+// Event describes the progress of the action for a single build iteration.
+type Event struct {
+	Type EventType `json:"type"`
+	// Name of the action: "build", "push", "tags" or "render".
+	Action string `json:"action"`
+	// Name of the build.
+	Build string `json:"build"`
+	// Values of the "for" variables for the iteration.
+	Vars map[string]string `json:"vars,omitempty"`
+	// Rendered primary tag of the iteration.
+	Tag string `json:"tag"`
+	// Rendered tags of the iteration other than the primary tag, including aliases.
+	AdditionalTags []string `json:"additionalTags,omitempty"`
+	// Time at which the event occurred.
+	Time time.Time `json:"time"`
+	// Amount of time that the action took. Only set for EventFinished.
+	Duration time.Duration `json:"durationNanos,omitempty"`
+	// Error returned by the action. Only set for EventFinished if the action failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Listener receives the events for a run. The events of a single run are delivered sequentially (Event is not called
+// concurrently for a single run).
+type Listener interface {
+	Event(event Event)
+}
+
+// ListenerFunc is a function that implements Listener.
+type ListenerFunc func(event Event)
+
+func (f ListenerFunc) Event(event Event) {
+	f(event)
+}
+
+// NewJSONListener returns a Listener that writes each event to the provided writer as a single line of JSON.
+func NewJSONListener(w io.Writer) Listener {
+	return &jsonListener{
+		w: w,
+	}
+}
+
+type jsonListener struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *jsonListener) Event(event Event) {
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(append(bytes, '\n'))
+}
+
+// unitEvent returns the event of the provided type for the provided unit.
+func unitEvent(eventType EventType, action string, unit buildUnit) Event {
+	return Event{
+		Type:           eventType,
+		Action:         action,
+		Build:          unit.build.Name,
+		Vars:           unit.iterVars,
+		Tag:            unit.tag,
+		AdditionalTags: unit.additionalTags,
+		Time:           time.Now(),
+	}
+}
+
+// emitStarted notifies the listener of the run that the action for the provided unit was started and returns the time
+// at which it was started.
+func (s *runState) emitStarted(unit buildUnit) time.Time {
+	event := unitEvent(EventStarted, s.actionName, unit)
+	if s.listener != nil {
+		s.listener.Event(event)
+	}
+	return event.Time
+}
+
+// emitFinished notifies the listener of the run that the action for the provided unit that was started at the provided
+// time completed with the provided error.
+func (s *runState) emitFinished(unit buildUnit, start time.Time, err error) {
+	if s.listener == nil {
+		return
+	}
+	event := unitEvent(EventFinished, s.actionName, unit)
+	event.Duration = event.Time.Sub(start)
+	if err != nil {
+		event.Error = err.Error()
+	}
+	s.listener.Event(event)
+}
+
+// emitSkipped notifies the listener of the run that the action for the provided unit was skipped.
+func (s *runState) emitSkipped(unit buildUnit) {
+	if s.listener != nil {
+		s.listener.Event(unitEvent(EventSkipped, s.actionName, unit))
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestEvents(t *testing.T) {
+	var cfg dockergen.Config
+	err := yaml.Unmarshal([]byte(`
+tag-suffix: -t1
+builds:
+  foo:
+    tag: test/foo:{{.version}}
+    aliases:
+      - test/foo:{{.version}}-latest
+    for:
+      version:
+        - "1"
+        - "2"
+  bar:
+    tag: test/bar
+    requires:
+      - foo
+`), &cfg)
+	require.NoError(t, err)
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	failingExecutor := funcExecutor(func(w io.Writer, name string, args ...string) error {
+		if args[len(args)-1] == "test/foo:2-t1" {
+			return fmt.Errorf("push failed")
+		}
+		return nil
+	})
+
+	type event struct {
+		eventType dockergen.EventType
+		tag       string
+		vars      map[string]string
+		err       string
+	}
+	for i, tc := range []struct {
+		name        string
+		parallelism int
+		executor    dockergen.Executor
+		want        []event
+	}{
+		{
+			"events are emitted for every iteration",
+			1,
+			&recordingExecutor{},
+			[]event{
+				{dockergen.EventStarted, "test/foo:1-t1", map[string]string{"version": "1"}, ""},
+				{dockergen.EventFinished, "test/foo:1-t1", map[string]string{"version": "1"}, ""},
+				{dockergen.EventStarted, "test/foo:2-t1", map[string]string{"version": "2"}, ""},
+				{dockergen.EventFinished, "test/foo:2-t1", map[string]string{"version": "2"}, ""},
+				{dockergen.EventStarted, "test/bar-t1", map[string]string{}, ""},
+				{dockergen.EventFinished, "test/bar-t1", map[string]string{}, ""},
+			},
+		},
+		{
+			"finished event records error",
+			1,
+			failingExecutor,
+			[]event{
+				{dockergen.EventStarted, "test/foo:1-t1", map[string]string{"version": "1"}, ""},
+				{dockergen.EventFinished, "test/foo:1-t1", map[string]string{"version": "1"}, ""},
+				{dockergen.EventStarted, "test/foo:2-t1", map[string]string{"version": "2"}, ""},
+				{dockergen.EventFinished, "test/foo:2-t1", map[string]string{"version": "2"}, "failed to execute command [push test/foo:2-t1]: push failed"},
+			},
+		},
+		{
+			"events are emitted when run in parallel",
+			2,
+			failingExecutor,
+			[]event{
+				{dockergen.EventStarted, "test/foo:1-t1", map[string]string{"version": "1"}, ""},
+				{dockergen.EventStarted, "test/foo:2-t1", map[string]string{"version": "2"}, ""},
+				{dockergen.EventFinished, "test/foo:1-t1", map[string]string{"version": "1"}, ""},
+				{dockergen.EventFinished, "test/foo:2-t1", map[string]string{"version": "2"}, "failed to execute command [push test/foo:2-t1]: push failed"},
+			},
+		},
+	} {
+		var got []event
+		params := cfg.ToParams()
+		params.Parallelism = tc.parallelism
+		params.Listener = dockergen.ListenerFunc(func(e dockergen.Event) {
+			assert.Equal(t, "push", e.Action, "Case %d: %s", i, tc.name)
+			assert.False(t, e.Time.IsZero(), "Case %d: %s", i, tc.name)
+			got = append(got, event{e.Type, e.Tag, e.Vars, e.Error})
+		})
+		executors := map[string]dockergen.Executor{"foo": tc.executor, "bar": tc.executor}
+		_ = dockergen.Push(executors, bParams, params, ioutil.Discard)
+
+		if tc.parallelism > 1 {
+			// the order in which concurrent units finish is not deterministic
+			require.Equal(t, len(tc.want), len(got), "Case %d: %s", i, tc.name)
+			assert.Equal(t, tc.want[:2], got[:2], "Case %d: %s", i, tc.name)
+			assert.ElementsMatch(t, tc.want[2:], got[2:], "Case %d: %s", i, tc.name)
+			continue
+		}
+		assert.Equal(t, tc.want, got, "Case %d: %s", i, tc.name)
+	}
+}
+
+func TestJSONListener(t *testing.T) {
+	buf := &bytes.Buffer{}
+	listener := dockergen.NewJSONListener(buf)
+	eventTime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	listener.Event(dockergen.Event{
+		Type:   dockergen.EventStarted,
+		Action: "build",
+		Build:  "foo",
+		Vars:   map[string]string{"version": "1"},
+		Tag:    "test/foo:1",
+		Time:   eventTime,
+	})
+	listener.Event(dockergen.Event{
+		Type:     dockergen.EventFinished,
+		Action:   "build",
+		Build:    "foo",
+		Vars:     map[string]string{"version": "1"},
+		Tag:      "test/foo:1",
+		Time:     eventTime,
+		Duration: time.Second,
+		Error:    "build failed",
+	})
+	assert.Equal(t, `{"type":"started","action":"build","build":"foo","vars":{"version":"1"},"tag":"test/foo:1","time":"2017-01-02T03:04:05Z"}
+{"type":"finished","action":"build","build":"foo","vars":{"version":"1"},"tag":"test/foo:1","time":"2017-01-02T03:04:05Z","durationNanos":1000000000,"error":"build failed"}
+`, buf.String())
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var event dockergen.Event
+		require.NoError(t, json.Unmarshal([]byte(line), &event))
+		assert.Equal(t, "foo", event.Build)
+	}
+}
@@ -5,27 +5,228 @@
 package dockergen
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
 	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 type Executor interface {
 	Run(w io.Writer, cmd string, args ...string) error
 }
 
+// Cmd is a command that is run by a ContextExecutor.
+type Cmd struct {
+	Name string
+	Args []string
+	// Environment of the command in the form "key=value". If nil, the command uses the environment of the current
+	// process.
+	Env []string
+	// Working directory of the command. If empty, the command is run in the working directory of the current process.
+	Dir string
+	// Standard input of the command. If nil, the command reads from the null device.
+	Stdin io.Reader
+	// Writers for the standard output and standard error of the command. If nil, the output is discarded.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ContextExecutor runs commands. Unlike Executor, it supports cancellation, the environment and working directory of
+// the command and separate writers for standard output and standard error.
+type ContextExecutor interface {
+	// RunContext runs the provided command. If the provided context is canceled or its deadline expires before the
+	// command completes, the command is stopped and an error is returned.
+	RunContext(ctx context.Context, cmd Cmd) error
+}
+
+// AdaptExecutor returns a ContextExecutor that runs commands using the provided executor. If the executor implements
+// ContextExecutor, it is returned unmodified. Otherwise, the returned executor runs commands using the Run method of
+// the provided executor with the standard output writer of the command (or the standard error writer if standard output
+// is nil). Because Run does not support cancellation, the context is only checked before the command is started, and
+// commands that specify an environment, working directory or standard input return an error.
+func AdaptExecutor(executor Executor) ContextExecutor {
+	if contextExecutor, ok := executor.(ContextExecutor); ok {
+		return contextExecutor
+	}
+	return &executorAdapter{
+		executor: executor,
+	}
+}
+
+type executorAdapter struct {
+	executor Executor
+}
+
+func (a *executorAdapter) RunContext(ctx context.Context, cmd Cmd) error {
+	if cmd.Env != nil || cmd.Dir != "" || cmd.Stdin != nil {
+		return errors.Errorf("executor %T does not support an environment, working directory or standard input", a.executor)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w := cmd.Stdout
+	if w == nil {
+		w = cmd.Stderr
+	}
+	if w == nil {
+		w = ioutil.Discard
+	}
+	return a.executor.Run(w, cmd.Name, cmd.Args...)
+}
+
+// ImageInspector is implemented by executors that can report information about images.
+type ImageInspector interface {
+	// InspectImage returns information about the image with the provided reference. Output that is not part of the
+	// result is written to the provided writer.
+	InspectImage(w io.Writer, ref string) (ImageInfo, error)
+}
+
+// ContextImageInspector is implemented by executors that can report information about images and that support
+// cancellation of the inspection.
+type ContextImageInspector interface {
+	// InspectImageContext returns information about the image with the provided reference. Output that is not part of
+	// the result is written to the provided writer. If the provided context is done before the inspection completes, an
+	// error is returned.
+	InspectImageContext(ctx context.Context, w io.Writer, ref string) (ImageInfo, error)
+}
+
+// ImageInfo is information about an image.
+type ImageInfo struct {
+	// ID of the image.
+	ID string `json:"Id"`
+	// Digests of the image in the repositories to which it has been pushed in the form "repository@digest".
+	RepoDigests []string `json:"RepoDigests"`
+}
+
+// digest returns the digest of the image in the repository of the provided tag. Returns an empty string if the image
+// does not have a digest for the repository.
+func (i ImageInfo) digest(tag string) string {
+	repo, _, _ := splitImageRef(tag)
+	for _, repoDigest := range i.RepoDigests {
+		if parts := strings.SplitN(repoDigest, "@", 2); len(parts) == 2 && parts[0] == repo {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+// isImageInspector returns true if the provided executor implements ImageInspector or ContextImageInspector.
+func isImageInspector(executor Executor) bool {
+	_, isInspector := executor.(ImageInspector)
+	_, isContextInspector := executor.(ContextImageInspector)
+	return isInspector || isContextInspector
+}
+
+// inspectImage returns the information for the image with the provided reference using the provided executor. If the
+// executor implements ContextImageInspector, the inspection is stopped when the provided context is done. If the
+// executor implements neither ContextImageInspector nor ImageInspector, returns an empty ImageInfo.
+func inspectImage(ctx context.Context, executor Executor, ref string, w io.Writer) (ImageInfo, error) {
+	var info ImageInfo
+	var err error
+	switch inspector := executor.(type) {
+	case ContextImageInspector:
+		info, err = inspector.InspectImageContext(ctx, w, ref)
+	case ImageInspector:
+		if err := ctx.Err(); err != nil {
+			return ImageInfo{}, err
+		}
+		info, err = inspector.InspectImage(w, ref)
+	default:
+		return ImageInfo{}, nil
+	}
+	if err != nil {
+		return ImageInfo{}, errors.Wrapf(err, "failed to inspect image %s", ref)
+	}
+	return info, nil
+}
+
+// inspectImageArgs are the arguments to the docker CLI that print the ImageInfo for an image as JSON.
+var inspectImageArgs = []string{"image", "inspect", "--format", `{"Id":{{json .Id}},"RepoDigests":{{json .RepoDigests}}}`}
+
 func NewCmdExecutor() Executor {
 	return &cmdExecutor{}
 }
 
+// cmdStopGracePeriod is the amount of time that a command run by cmdExecutor is given to exit after it is interrupted
+// because its context was canceled before it is killed.
+const cmdStopGracePeriod = 10 * time.Second
+
 type cmdExecutor struct{}
 
 func (e *cmdExecutor) Run(w io.Writer, name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	cmd.Stdout = w
+	return e.RunContext(context.Background(), Cmd{
+		Name:   name,
+		Args:   args,
+		Stdout: w,
+		Stderr: w,
+	})
+}
+
+// RunContext runs the provided command. If the context is done before the command completes, the command is sent an
+// interrupt signal so that it can exit cleanly and is killed if it has not exited after cmdStopGracePeriod.
+func (e *cmdExecutor) RunContext(ctx context.Context, c Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cmd := exec.Command(c.Name, c.Args...)
+	cmd.Env = c.Env
+	cmd.Dir = c.Dir
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = c.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	_ = cmd.Process.Signal(os.Interrupt)
+	timer := time.NewTimer(cmdStopGracePeriod)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		_ = cmd.Process.Kill()
+		<-done
+	}
+	return errors.Wrapf(ctx.Err(), "command %s %v was stopped", c.Name, c.Args)
+}
+
+func (e *cmdExecutor) InspectImage(w io.Writer, ref string) (ImageInfo, error) {
+	return e.InspectImageContext(context.Background(), w, ref)
+}
+
+// InspectImageContext inspects the image using the docker CLI. The command is killed if the context is done before it
+// completes.
+func (e *cmdExecutor) InspectImageContext(ctx context.Context, w io.Writer, ref string) (ImageInfo, error) {
+	stdout := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, "docker", append(inspectImageArgs, ref)...)
+	cmd.Stdout = stdout
 	cmd.Stderr = w
-	return cmd.Run()
+	if err := cmd.Run(); err != nil {
+		return ImageInfo{}, err
+	}
+	var info ImageInfo
+	if err := json.Unmarshal(stdout.Bytes(), &info); err != nil {
+		return ImageInfo{}, errors.Wrapf(err, "failed to parse output %q", stdout.String())
+	}
+	return info, nil
 }
 
 func NewPrintCmdExecutor() Executor {
@@ -39,6 +240,22 @@ func (e *printCmdExecutor) Run(w io.Writer, name string, args ...string) error {
 	return err
 }
 
+// RunContext prints the provided command to its standard output writer. The environment, working directory and standard
+// input of the command are ignored.
+func (e *printCmdExecutor) RunContext(ctx context.Context, cmd Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cmd.Stdout == nil {
+		return nil
+	}
+	return e.Run(cmd.Stdout, cmd.Name, cmd.Args...)
+}
+
+func (e *printCmdExecutor) InspectImage(w io.Writer, ref string) (ImageInfo, error) {
+	return ImageInfo{}, e.Run(w, "docker", append(inspectImageArgs, ref)...)
+}
+
 func NoopExecutor() Executor {
 	return &noopExecutor{}
 }
@@ -48,3 +265,7 @@ type noopExecutor struct{}
 func (e *noopExecutor) Run(w io.Writer, name string, args ...string) error {
 	return nil
 }
+
+func (e *noopExecutor) RunContext(ctx context.Context, cmd Cmd) error {
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestCmdExecutorRunContext(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+
+	executor, ok := dockergen.NewCmdExecutor().(dockergen.ContextExecutor)
+	require.True(t, ok)
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	err = executor.RunContext(context.Background(), dockergen.Cmd{
+		Name:   "sh",
+		Args:   []string{"-c", `cat; echo "$DOCKERGEN_TEST_VAR"; pwd; echo error >&2`},
+		Env:    []string{"DOCKERGEN_TEST_VAR=value"},
+		Dir:    tmpDir,
+		Stdin:  strings.NewReader("input\n"),
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+	require.NoError(t, err)
+	// the temporary directory may be a symlink, so compare against the resolved path
+	expectedDir, err := filepath.EvalSymlinks(tmpDir)
+	require.NoError(t, err)
+	assert.Equal(t, "input\nvalue\n"+expectedDir+"\n", stdout.String())
+	assert.Equal(t, "error\n", stderr.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = executor.RunContext(ctx, dockergen.Cmd{
+		Name: "sleep",
+		Args: []string{"10"},
+	})
+	require.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.True(t, time.Since(start) < 5*time.Second, "command was not stopped: ran for %v", time.Since(start))
+}
+
+func TestAdaptExecutor(t *testing.T) {
+	executor := &recordingExecutor{}
+	adapted := dockergen.AdaptExecutor(executor)
+
+	err := adapted.RunContext(context.Background(), dockergen.Cmd{
+		Name: "docker",
+		Args: []string{"push", "test/foo"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"docker", "push", "test/foo"}}, executor.commands)
+
+	err = adapted.RunContext(context.Background(), dockergen.Cmd{
+		Name: "docker",
+		Args: []string{"push", "test/foo"},
+		Dir:  "dir",
+	})
+	assert.EqualError(t, err, "executor *dockergen_test.recordingExecutor does not support an environment, working directory or standard input")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = adapted.RunContext(ctx, dockergen.Cmd{
+		Name: "docker",
+		Args: []string{"push", "test/foo"},
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, len(executor.commands))
+
+	// executors that implement ContextExecutor are returned unmodified
+	cmdExecutor := dockergen.NewCmdExecutor()
+	assert.Equal(t, cmdExecutor, dockergen.AdaptExecutor(cmdExecutor))
+}
+
+func TestBuildCanceled(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, "Dockerfile_template.txt"), []byte("FROM scratch\n"), 0644))
+
+	var cfg dockergen.Config
+	err = yaml.Unmarshal([]byte(`
+builds:
+  foo:
+    docker-template: Dockerfile_template.txt
+    tag: test/foo
+`), &cfg)
+	require.NoError(t, err)
+	cfg.Dir = tmpDir
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	for _, parallelism := range []int{1, 2} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		executor := &recordingExecutor{}
+		params := cfg.ToParams()
+		params.Parallelism = parallelism
+		err = dockergen.BuildContext(ctx, map[string]dockergen.Executor{"foo": executor}, bParams, params, ioutil.Discard)
+		require.Error(t, err, "parallelism %d", parallelism)
+		assert.Equal(t, context.Canceled, errors.Cause(err), "parallelism %d", parallelism)
+		assert.Empty(t, executor.commands, "parallelism %d", parallelism)
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// libraryFuncs returns the general-purpose functions that are available to all templates. The argument that is
+// typically piped is the last argument of every function. Relative paths that are read by the functions are resolved
+// relative to the provided directory.
+func libraryFuncs(dir string) template.FuncMap {
+	return template.FuncMap{
+		"replace": func(old, new, s string) string {
+			return strings.Replace(s, old, new, -1)
+		},
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":       join,
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+
+		"semver":        parseSemver,
+		"semverCompare": semverCompare,
+
+		"default":  defaultValue,
+		"required": required,
+
+		"readFile": func(path string) (string, error) {
+			bytes, err := ioutil.ReadFile(resolvePath(dir, path))
+			if err != nil {
+				return "", errors.Wrapf(err, "failed to read file")
+			}
+			return string(bytes), nil
+		},
+		"sha256sum": func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		},
+		"toJson": func(v interface{}) (string, error) {
+			bytes, err := json.Marshal(v)
+			if err != nil {
+				return "", errors.Wrapf(err, "failed to marshal value as JSON")
+			}
+			return string(bytes), nil
+		},
+		"toYaml": func(v interface{}) (string, error) {
+			bytes, err := yaml.Marshal(v)
+			if err != nil {
+				return "", errors.Wrapf(err, "failed to marshal value as YAML")
+			}
+			return strings.TrimSuffix(string(bytes), "\n"), nil
+		},
+
+		"now":  func() time.Time { return time.Now().UTC() },
+		"date": formatDate,
+	}
+}
+
+// join returns the elements of the provided list, which must be a slice or array, formatted and joined with the provided
+// separator.
+func join(sep string, list interface{}) (string, error) {
+	val := reflect.ValueOf(list)
+	if list == nil || (val.Kind() != reflect.Slice && val.Kind() != reflect.Array) {
+		return "", errors.Errorf("join requires a list, was %T", list)
+	}
+	parts := make([]string, val.Len())
+	for i := range parts {
+		parts[i] = fmt.Sprint(val.Index(i).Interface())
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// defaultValue returns the provided default if the provided value is empty and the value otherwise.
+func defaultValue(def, val interface{}) interface{} {
+	if isEmpty(val) {
+		return def
+	}
+	return val
+}
+
+// required returns the provided value if it is not empty and an error with the provided message otherwise.
+func required(msg string, val interface{}) (interface{}, error) {
+	if isEmpty(val) {
+		return nil, errors.New(msg)
+	}
+	return val, nil
+}
+
+// isEmpty returns true if the provided value is nil or the zero value of its type or if it is an empty slice, map or
+// string.
+func isEmpty(val interface{}) bool {
+	if val == nil {
+		return true
+	}
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	default:
+		return reflect.DeepEqual(val, reflect.Zero(v.Type()).Interface())
+	}
+}
+
+// formatDate formats the provided time, which must be a time.Time or a Unix timestamp in seconds, using the provided
+// layout of the time package. The time is formatted in UTC.
+func formatDate(layout string, t interface{}) (string, error) {
+	switch v := t.(type) {
+	case time.Time:
+		return v.UTC().Format(layout), nil
+	case int:
+		return time.Unix(int64(v), 0).UTC().Format(layout), nil
+	case int64:
+		return time.Unix(v, 0).UTC().Format(layout), nil
+	case string:
+		secs, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", errors.Errorf("date requires a time or a Unix timestamp, was %q", v)
+		}
+		return time.Unix(secs, 0).UTC().Format(layout), nil
+	default:
+		return "", errors.Errorf("date requires a time or a Unix timestamp, was %T", t)
+	}
+}
+
+// semverVersion is a semantic version as defined by https://semver.org. A leading "v" is permitted.
+type semverVersion struct {
+	Major      int64
+	Minor      int64
+	Patch      int64
+	Prerelease string
+	Metadata   string
+}
+
+func (v semverVersion) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+	if v.Metadata != "" {
+		s += "+" + v.Metadata
+	}
+	return s
+}
+
+// parseSemver parses the provided semantic version.
+func parseSemver(s string) (semverVersion, error) {
+	rest := strings.TrimPrefix(s, "v")
+	var v semverVersion
+	if i := strings.Index(rest, "+"); i != -1 {
+		v.Metadata = rest[i+1:]
+		rest = rest[:i]
+	}
+	if i := strings.Index(rest, "-"); i != -1 {
+		v.Prerelease = rest[i+1:]
+		rest = rest[:i]
+	}
+	parts := strings.Split(rest, ".")
+	if len(parts) != 3 {
+		return semverVersion{}, errors.Errorf("invalid semantic version %q: must be of the form MAJOR.MINOR.PATCH", s)
+	}
+	for i, dst := range []*int64{&v.Major, &v.Minor, &v.Patch} {
+		num, err := strconv.ParseInt(parts[i], 10, 64)
+		if err != nil || num < 0 {
+			return semverVersion{}, errors.Errorf("invalid semantic version %q: %q is not a non-negative integer", s, parts[i])
+		}
+		*dst = num
+	}
+	return v, nil
+}
+
+// compare returns -1, 0 or 1 if this version has a lower, equal or higher precedence than the provided version. Build
+// metadata is ignored.
+func (v semverVersion) compare(other semverVersion) int {
+	for _, pair := range [][2]int64{{v.Major, other.Major}, {v.Minor, other.Minor}, {v.Patch, other.Patch}} {
+		if pair[0] != pair[1] {
+			if pair[0] < pair[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	// a version without a prerelease has a higher precedence than one with a prerelease
+	switch {
+	case v.Prerelease == other.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case other.Prerelease == "":
+		return -1
+	}
+	ids, otherIDs := strings.Split(v.Prerelease, "."), strings.Split(other.Prerelease, ".")
+	for i := 0; i < len(ids) && i < len(otherIDs); i++ {
+		if c := comparePrereleaseIDs(ids[i], otherIDs[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(ids) < len(otherIDs):
+		return -1
+	case len(ids) > len(otherIDs):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// comparePrereleaseIDs compares two prerelease identifiers. Numeric identifiers are compared numerically and have a lower
+// precedence than alphanumeric identifiers, which are compared lexically.
+func comparePrereleaseIDs(a, b string) int {
+	aNum, aErr := strconv.ParseInt(a, 10, 64)
+	bNum, bErr := strconv.ParseInt(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		switch {
+		case aNum < bNum:
+			return -1
+		case aNum > bNum:
+			return 1
+		default:
+			return 0
+		}
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// semverCompare returns true if the provided version satisfies the provided constraint. A constraint is a comma-separated
+// list of comparisons that must all be satisfied, where a comparison is an operator ("=", "!=", ">", ">=", "<" or "<=")
+// followed by a version. If the operator is omitted, it is "=".
+func semverCompare(constraint, version string) (bool, error) {
+	v, err := parseSemver(version)
+	if err != nil {
+		return false, err
+	}
+	for _, comparison := range strings.Split(constraint, ",") {
+		comparison = strings.TrimSpace(comparison)
+		versionPart := strings.TrimLeft(comparison, "=!<>")
+		op := comparison[:len(comparison)-len(versionPart)]
+		other, err := parseSemver(strings.TrimSpace(versionPart))
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid constraint %q", constraint)
+		}
+		c := v.compare(other)
+		var satisfied bool
+		switch op {
+		case "", "=", "==":
+			satisfied = c == 0
+		case "!=":
+			satisfied = c != 0
+		case ">":
+			satisfied = c > 0
+		case ">=":
+			satisfied = c >= 0
+		case "<":
+			satisfied = c < 0
+		case "<=":
+			satisfied = c <= 0
+		default:
+			return false, errors.Errorf("invalid constraint %q: unknown operator %q", constraint, op)
+		}
+		if !satisfied {
+			return false, nil
+		}
+	}
+	return true, nil
+}
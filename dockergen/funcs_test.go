@@ -0,0 +1,121 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, "version.txt"), []byte("1.9.2\n"), 0644))
+
+	for i, tc := range []struct {
+		name      string
+		tmpl      string
+		want      string
+		wantError string
+	}{
+		{
+			"string functions",
+			`{{ .version | replace "." "_" }}-{{ "  Foo " | trim | lower }}-{{ upper "bar" }}-{{ trimPrefix "go" "go1.9" }}`,
+			"1_9_2-foo-BAR-1.9",
+			"",
+		},
+		{
+			"split and join",
+			`{{ split "." .version | join "-" }}`,
+			"1-9-2",
+			"",
+		},
+		{
+			"semver parses versions",
+			`{{ (semver .version).Minor }}-{{ semver "v2.0.0-rc.1+build.5" }}`,
+			"9-2.0.0-rc.1+build.5",
+			"",
+		},
+		{
+			"semverCompare evaluates constraints",
+			`{{ semverCompare ">=1.9.0, <2.0.0" .version }}-{{ semverCompare ">1.9.2" .version }}-{{ semverCompare "<1.0.0" "1.0.0-rc.1" }}`,
+			"true-false-true",
+			"",
+		},
+		{
+			"default is used for empty and missing values",
+			`{{ default "none" .missing }}-{{ default "none" "" }}-{{ default "none" .version }}`,
+			"none-none-1.9.2",
+			"",
+		},
+		{
+			"required fails for missing values",
+			`{{ required "registry must be set" .registry }}`,
+			"",
+			"registry must be set",
+		},
+		{
+			"readFile resolves relative paths relative to the directory of the build",
+			`{{ readFile "version.txt" | trim }}`,
+			"1.9.2",
+			"",
+		},
+		{
+			"sha256sum",
+			`{{ sha256sum "foo" }}`,
+			"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			"",
+		},
+		{
+			"toJson and toYaml",
+			`{{ split "." .version | toJson }}-{{ "foo" | toYaml }}`,
+			`["1","9","2"]-foo`,
+			"",
+		},
+		{
+			"date formats times in UTC",
+			`{{ date "2006-01-02T15:04" 1500000000 }}-{{ now | date "2006" | len }}`,
+			"2017-07-14T02:40-4",
+			"",
+		},
+	} {
+		yml := `
+template-vars:
+  version: 1.9.2
+builds:
+  foo:
+    tag: test/foo
+    aliases:
+      - '` + tc.tmpl + `'
+`
+		var cfg dockergen.Config
+		require.NoError(t, yaml.Unmarshal([]byte(yml), &cfg), "Case %d: %s", i, tc.name)
+		cfg.Dir = tmpDir
+		bParams, err := cfg.BuildParams()
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		buf := &bytes.Buffer{}
+		err = dockergen.Tags(nil, bParams, cfg.ToParams(), buf)
+		if tc.wantError != "" {
+			require.Error(t, err, fmt.Sprintf("Case %d: %s", i, tc.name))
+			assert.Contains(t, err.Error(), tc.wantError, "Case %d: %s", i, tc.name)
+			continue
+		}
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		assert.Equal(t, tc.want, lines[len(lines)-1], "Case %d: %s", i, tc.name)
+	}
+}
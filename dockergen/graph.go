@@ -0,0 +1,216 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Graph is the dependency graph of builds.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphNode is a build or, for an expanded graph, a single iteration of a build.
+type GraphNode struct {
+	// Unique identifier of the node.
+	ID string `json:"id"`
+	// Name of the build.
+	Build string `json:"build"`
+	// Values of the "for" variables for the iteration. Only set for expanded graphs.
+	Vars map[string]string `json:"vars,omitempty"`
+	// Rendered primary tag of the iteration. Only set for expanded graphs.
+	Tag string `json:"tag,omitempty"`
+}
+
+// GraphEdge specifies that the node with the ID From is required by the node with the ID To.
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// BuildGraph returns the dependency graph of the provided builds. If expand is false, the graph contains a node for
+// every build and an edge from every build to each of the builds that require it. If expand is true, the graph
+// contains a node for every iteration of every build and an edge from every iteration to each iteration whose templates
+// reference its tag using the "Tag" or "TagFor" template functions. Expanding the graph renders all of the templates.
+func BuildGraph(builds []BuildParams, params Params, expand bool) (Graph, error) {
+	if !expand {
+		return buildGraph(builds), nil
+	}
+	units, tags, err := planRun(builds, params)
+	if err != nil {
+		return Graph{}, err
+	}
+
+	graph := Graph{
+		Nodes: []GraphNode{},
+		Edges: []GraphEdge{},
+	}
+	innerIdxs := make(map[string]int)
+	ids := make([]string, len(units))
+	for i, unit := range units {
+		ids[i] = fmt.Sprintf("%s[%d]", unit.build.Name, innerIdxs[unit.build.Name])
+		innerIdxs[unit.build.Name]++
+		graph.Nodes = append(graph.Nodes, GraphNode{
+			ID:    ids[i],
+			Build: unit.build.Name,
+			Vars:  unit.iterVars,
+			Tag:   unit.tag,
+		})
+	}
+	for i, unit := range units {
+		referenced, err := referencedUnits(unit, tags)
+		if err != nil {
+			return Graph{}, errors.Wrapf(err, "failed to render templates for %s", unit.build.Name)
+		}
+		for _, ref := range referenced {
+			graph.Edges = append(graph.Edges, GraphEdge{
+				From: ids[ref],
+				To:   ids[i],
+			})
+		}
+	}
+	return graph, nil
+}
+
+func buildGraph(builds []BuildParams) Graph {
+	graph := Graph{
+		Nodes: []GraphNode{},
+		Edges: []GraphEdge{},
+	}
+	for _, build := range TopologicalSort(builds) {
+		graph.Nodes = append(graph.Nodes, GraphNode{
+			ID:    build.Name,
+			Build: build.Name,
+		})
+		requires := append([]string(nil), build.Requires...)
+		sort.Strings(requires)
+		for i, req := range requires {
+			if i > 0 && requires[i-1] == req {
+				continue
+			}
+			graph.Edges = append(graph.Edges, GraphEdge{
+				From: req,
+				To:   build.Name,
+			})
+		}
+	}
+	return graph
+}
+
+// referencedUnits renders all of the templates of the provided unit and returns the sorted indexes of the units whose
+// tags are looked up in the provided store by the templates.
+func referencedUnits(unit buildUnit, tags *tagStore) ([]int, error) {
+	seen := make(map[int]struct{})
+	state := &runState{
+		tags: tags.tracking(func(unitIdx int) {
+			seen[unitIdx] = struct{}{}
+		}),
+	}
+	params := unit.runParams(state, ioutil.Discard)
+
+	var tmpls []string
+	tmpls = append(tmpls, unit.build.Tag)
+	tmpls = append(tmpls, unit.build.Tags...)
+	tmpls = append(tmpls, unit.build.Aliases...)
+	for _, tmpl := range tmpls {
+		if _, err := params.render(tmpl); err != nil {
+			return nil, err
+		}
+	}
+	if unit.build.DockerfileTemplatePath != "" {
+		if _, err := renderDockerfile(params); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := unit.build.BuildOptions.render(params.render); err != nil {
+		return nil, err
+	}
+	if _, err := renderContextDir(params); err != nil {
+		return nil, err
+	}
+	if _, _, err := renderDockerignore(params); err != nil {
+		return nil, err
+	}
+
+	var referenced []int
+	for idx := range seen {
+		referenced = append(referenced, idx)
+	}
+	sort.Ints(referenced)
+	return referenced, nil
+}
+
+// WriteDOT writes the graph in the Graphviz DOT format.
+func (g Graph) WriteDOT(w io.Writer) error {
+	var lines []string
+	lines = append(lines, "digraph dockergen {")
+	for _, node := range g.Nodes {
+		lines = append(lines, fmt.Sprintf("  %s [label=%s];", dotQuote(node.ID), dotQuote(strings.Join(node.labelLines(), "\n"))))
+	}
+	for _, edge := range g.Edges {
+		lines = append(lines, fmt.Sprintf("  %s -> %s;", dotQuote(edge.From), dotQuote(edge.To)))
+	}
+	lines = append(lines, "}")
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// WriteMermaid writes the graph as a Mermaid flowchart.
+func (g Graph) WriteMermaid(w io.Writer) error {
+	var lines []string
+	lines = append(lines, "graph LR")
+	// Mermaid node IDs cannot contain most punctuation, so nodes are identified by their index
+	mermaidIDs := make(map[string]string, len(g.Nodes))
+	for i, node := range g.Nodes {
+		mermaidIDs[node.ID] = fmt.Sprintf("n%d", i)
+		var labelLines []string
+		for _, line := range node.labelLines() {
+			labelLines = append(labelLines, strings.Replace(line, `"`, "#quot;", -1))
+		}
+		lines = append(lines, fmt.Sprintf(`  %s["%s"]`, mermaidIDs[node.ID], strings.Join(labelLines, "<br/>")))
+	}
+	for _, edge := range g.Edges {
+		lines = append(lines, fmt.Sprintf("  %s --> %s", mermaidIDs[edge.From], mermaidIDs[edge.To]))
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// WriteJSON writes the graph as indented JSON.
+func (g Graph) WriteJSON(w io.Writer) error {
+	bytes, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal graph")
+	}
+	_, err = w.Write(append(bytes, '\n'))
+	return err
+}
+
+// labelLines returns the lines of the label of the node: the name of the build followed by the tag and variables of
+// the iteration for expanded graphs.
+func (n GraphNode) labelLines() []string {
+	lines := []string{n.Build}
+	if n.Tag != "" {
+		lines = append(lines, n.Tag)
+	}
+	if len(n.Vars) != 0 {
+		lines = append(lines, formatVars(n.Vars))
+	}
+	return lines
+}
+
+// dotQuote returns the provided string as a quoted DOT identifier.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestBuildGraph(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, "app_template.txt"), []byte(`FROM {{TagFor "base" "jdk" "jdk8"}}`+"\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, "tool_template.txt"), []byte(`FROM {{Tag "base" 0 InnerIdx}}`+"\n"), 0644))
+
+	var cfg dockergen.Config
+	err = yaml.Unmarshal([]byte(`
+tag-suffix: -t1
+builds:
+  base:
+    tag: test/base:{{.jdk}}
+    for:
+      jdk:
+        - jdk7
+        - jdk8
+  app:
+    docker-template: app_template.txt
+    tag: test/app
+    requires:
+      - base
+  tool:
+    docker-template: tool_template.txt
+    tag: test/tool:{{.idx}}
+    for:
+      idx:
+        - "0"
+        - "1"
+    requires:
+      - base
+      - app
+`), &cfg)
+	require.NoError(t, err)
+	cfg.Dir = tmpDir
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	graph, err := dockergen.BuildGraph(bParams, cfg.ToParams(), false)
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, graph.WriteDOT(buf))
+	assert.Equal(t, `digraph dockergen {
+  "base" [label="base"];
+  "app" [label="app"];
+  "tool" [label="tool"];
+  "base" -> "app";
+  "app" -> "tool";
+  "base" -> "tool";
+}
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, graph.WriteMermaid(buf))
+	assert.Equal(t, `graph LR
+  n0["base"]
+  n1["app"]
+  n2["tool"]
+  n0 --> n1
+  n1 --> n2
+  n0 --> n2
+`, buf.String())
+
+	expanded, err := dockergen.BuildGraph(bParams, cfg.ToParams(), true)
+	require.NoError(t, err)
+	assert.Equal(t, dockergen.Graph{
+		Nodes: []dockergen.GraphNode{
+			{ID: "base[0]", Build: "base", Vars: map[string]string{"jdk": "jdk7"}, Tag: "test/base:jdk7-t1"},
+			{ID: "base[1]", Build: "base", Vars: map[string]string{"jdk": "jdk8"}, Tag: "test/base:jdk8-t1"},
+			{ID: "app[0]", Build: "app", Vars: map[string]string{}, Tag: "test/app-t1"},
+			{ID: "tool[0]", Build: "tool", Vars: map[string]string{"idx": "0"}, Tag: "test/tool:0-t1"},
+			{ID: "tool[1]", Build: "tool", Vars: map[string]string{"idx": "1"}, Tag: "test/tool:1-t1"},
+		},
+		Edges: []dockergen.GraphEdge{
+			{From: "base[1]", To: "app[0]"},
+			{From: "base[0]", To: "tool[0]"},
+			{From: "base[1]", To: "tool[1]"},
+		},
+	}, expanded)
+
+	buf.Reset()
+	require.NoError(t, expanded.WriteDOT(buf))
+	assert.Contains(t, buf.String(), `  "base[1]" [label="base\ntest/base:jdk8-t1\n{jdk=jdk8}"];`)
+}
@@ -0,0 +1,317 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is a decoded configuration file.
+type configFile struct {
+	path string
+	// root node of the file, which records the positions of its keys
+	node yaml.Node
+	cfg  Config
+	// problems for the keys in the file that do not correspond to a configuration field
+	unknownKeys []ValidationError
+	// positions of the keys in the file. Computed lazily by keyPositions.
+	positions yamlKeyPositions
+}
+
+// keyPositions returns the positions of the keys in the file.
+func (f *configFile) keyPositions() yamlKeyPositions {
+	if f.positions == nil {
+		f.positions = nodeKeyPositions(&f.node)
+	}
+	return f.positions
+}
+
+// loadConfigFiles reads and decodes the configuration file at the provided path and, recursively, the files that it
+// includes. Returns the files in the order in which they were loaded starting with the file at the provided path. A
+// file that is included more than once is only loaded once. Duplicate keys are decoding errors and, if strict is true,
+// so are unknown keys (otherwise, they are recorded in the unknownKeys of the file). Keys whose values define an
+// anchor are not unknown. If a file cannot be decoded, the returned error is a *ConfigError.
+func loadConfigFiles(path string, strict bool) ([]*configFile, error) {
+	var files []*configFile
+	loaded := make(map[string]struct{})
+
+	var load func(path string, includedBy []string) error
+	load = func(path string, includedBy []string) error {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to determine absolute path of %s", path)
+		}
+		for i, curr := range includedBy {
+			if curr == absPath {
+				return errors.Errorf("include cycle exists: %s", strings.Join(append(includedBy[i:], absPath), " -> "))
+			}
+		}
+		if _, ok := loaded[absPath]; ok {
+			return nil
+		}
+		loaded[absPath] = struct{}{}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read config file")
+		}
+		file := &configFile{
+			path: path,
+		}
+		if err := yaml.Unmarshal(data, &file.node); err != nil {
+			return &ConfigError{
+				Path:   path,
+				Errors: yamlErrors(err, nil),
+			}
+		}
+		var verrs []ValidationError
+		// the node of an empty file is empty
+		if file.node.Kind != 0 {
+			decoder := yaml.NewDecoder(bytes.NewReader(data))
+			decoder.KnownFields(true)
+			if err := decoder.Decode(&file.cfg); err != nil {
+				for _, verr := range yamlErrors(err, &file.node) {
+					keyPath, key, value := unknownKey(&file.node, verr)
+					switch {
+					case key == nil:
+						verrs = append(verrs, verr)
+					case value.Anchor != "":
+						// the key holds a value that is referenced elsewhere in the file (for example, defaults that
+						// are merged into builds), so it is not unknown
+					default:
+						file.unknownKeys = append(file.unknownKeys, ValidationError{
+							Line:    key.Line,
+							Column:  key.Column,
+							Message: fmt.Sprintf("unknown key %q", keyPath),
+						})
+					}
+				}
+			}
+		}
+		if strict {
+			verrs = append(verrs, file.unknownKeys...)
+		}
+		if len(verrs) != 0 {
+			sort.SliceStable(verrs, func(i, j int) bool {
+				if verrs[i].Line != verrs[j].Line {
+					return verrs[i].Line < verrs[j].Line
+				}
+				return verrs[i].Column < verrs[j].Column
+			})
+			return &ConfigError{
+				Path:   path,
+				Errors: verrs,
+			}
+		}
+		file.cfg.Dir = filepath.Dir(path)
+		files = append(files, file)
+
+		for _, pattern := range file.cfg.Include {
+			matches, err := filepath.Glob(resolvePath(file.cfg.baseDir(), pattern))
+			if err != nil {
+				return errors.Wrapf(err, "invalid include pattern %s in %s", pattern, path)
+			}
+			if len(matches) == 0 {
+				return errors.Errorf("include pattern %s in %s does not match any files", pattern, path)
+			}
+			for _, match := range matches {
+				if err := load(match, append(includedBy, absPath)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := load(path, nil); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// mergeConfigFiles returns the configuration of the first of the provided files with the builds, template variables,
+// "for" variables, matrix and profiles of the other files merged into it. The relative paths of the builds and of the
+// build overrides of the profiles of every file are resolved relative to the directory of that file, and the default
+// build and retry options of every file apply to the builds of that file. Profiles with the same name are merged.
+// Returns the conflicts between the files: builds with the same name, different values for the same template variable,
+// "for" variable, matrix, build ID variable or tag suffix and profiles with the same name that conflict in the same way
+// or override the same build.
+func mergeConfigFiles(files []*configFile) (Config, []ValidationError) {
+	merged := files[0].cfg
+	merged.TemplateVars = mergeStringMaps(merged.TemplateVars)
+	merged.For = copyForVars(merged.For)
+	merged.Builds = append(BuildYMLs(nil), merged.Builds...)
+	merged.Profiles = make(map[string]Profile, len(merged.Profiles))
+	for name, profile := range files[0].cfg.Profiles {
+		merged.Profiles[name] = profile.copy().withResolvedPaths(files[0].cfg.baseDir())
+	}
+
+	buildFiles := make(map[string]string)
+	for _, item := range merged.Builds {
+		buildFiles[fmt.Sprint(item.Key)] = files[0].path
+	}
+
+	var verrs []ValidationError
+	for _, file := range files[1:] {
+		conflictf := func(keyPath, format string, args ...interface{}) {
+			pos := file.keyPositions().pos(keyPath)
+			verrs = append(verrs, ValidationError{
+				File:    file.path,
+				Line:    pos.line,
+				Column:  pos.column,
+				Message: fmt.Sprintf(format, args...),
+			})
+		}
+		cfg := file.cfg
+
+		mergeSettings(&merged.BuildIDVar, &merged.TagSuffix, &merged.TemplateVars, cfg.BuildIDVar, cfg.TagSuffix, cfg.TemplateVars, "", conflictf)
+		for _, k := range sortedForVarNames(cfg.For) {
+			v := cfg.For[k]
+			if existing, ok := merged.For[k]; ok && !reflect.DeepEqual(existing, v) {
+				conflictf("for."+k, "'for' variable %s is %v, which conflicts with the value %v of another configuration file", k, v, existing)
+				continue
+			}
+			if merged.For == nil {
+				merged.For = make(map[string][]string)
+			}
+			merged.For[k] = v
+		}
+		if cfg.Matrix != nil {
+			if merged.Matrix == nil {
+				merged.Matrix = cfg.Matrix
+			} else if !reflect.DeepEqual(merged.Matrix, cfg.Matrix) {
+				conflictf("matrix", "matrix conflicts with the matrix of another configuration file")
+			}
+		}
+
+		dir := cfg.baseDir()
+		for _, name := range sortedProfileNames(cfg.Profiles) {
+			profile := cfg.Profiles[name].copy().withResolvedPaths(dir)
+			mergedProfile, ok := merged.Profiles[name]
+			if !ok {
+				merged.Profiles[name] = profile
+				continue
+			}
+			keyPrefix := "profiles." + name + "."
+			mergeSettings(&mergedProfile.BuildIDVar, &mergedProfile.TagSuffix, &mergedProfile.TemplateVars, profile.BuildIDVar, profile.TagSuffix, profile.TemplateVars, keyPrefix, conflictf)
+			for _, buildName := range sortedBuildConfigNames(profile.Builds) {
+				if _, ok := mergedProfile.Builds[buildName]; ok {
+					conflictf(keyPrefix+"builds."+buildName, "profile %s overrides build %s, which is already overridden by the profile in another configuration file", name, buildName)
+					continue
+				}
+				if mergedProfile.Builds == nil {
+					mergedProfile.Builds = make(map[string]BuildConfig)
+				}
+				mergedProfile.Builds[buildName] = profile.Builds[buildName]
+			}
+			merged.Profiles[name] = mergedProfile
+		}
+
+		// the partials of every file are resolved relative to that file and are available to the builds of all files
+		merged.includedPartials = append(merged.includedPartials, cfg.partialPatterns()...)
+
+		for _, item := range cfg.Builds {
+			name := fmt.Sprint(item.Key)
+			if otherFile, ok := buildFiles[name]; ok {
+				conflictf("builds."+name, "build %s is already defined in %s", name, otherFile)
+				continue
+			}
+			buildFiles[name] = file.path
+			build := item.Value.(BuildConfig)
+			build.dir = &dir
+			build.DockerBuildOptions = build.DockerBuildOptions.withDefaults(cfg.DockerBuildOptions)
+			build.RetryOptions = build.RetryOptions.withDefaults(cfg.RetryOptions)
+			merged.Builds = append(merged.Builds, yamlv2.MapItem{
+				Key:   name,
+				Value: build,
+			})
+		}
+	}
+	return merged, verrs
+}
+
+// mergeSettings merges the provided build ID variable, tag suffix and template variables of a configuration file into
+// the provided merged values and reports conflicts. The provided prefix is prepended to the paths of the keys of the
+// conflicts.
+func mergeSettings(mergedBuildIDVar, mergedTagSuffix *string, mergedTemplateVars *map[string]string, buildIDVar, tagSuffix string, templateVars map[string]string, keyPrefix string, conflictf func(keyPath, format string, args ...interface{})) {
+	for _, field := range []struct {
+		key    string
+		merged *string
+		val    string
+	}{
+		{"build-id-var", mergedBuildIDVar, buildIDVar},
+		{"tag-suffix", mergedTagSuffix, tagSuffix},
+	} {
+		switch {
+		case field.val == "" || field.val == *field.merged:
+		case *field.merged == "":
+			*field.merged = field.val
+		default:
+			conflictf(keyPrefix+field.key, "%s is %q, which conflicts with the value %q of another configuration file", keyPrefix+field.key, field.val, *field.merged)
+		}
+	}
+	for _, k := range sortedKeys(templateVars) {
+		v := templateVars[k]
+		if existing, ok := (*mergedTemplateVars)[k]; ok && existing != v {
+			conflictf(keyPrefix+"template-vars."+k, "template variable %s is %q, which conflicts with the value %q of another configuration file", k, v, existing)
+			continue
+		}
+		if *mergedTemplateVars == nil {
+			*mergedTemplateVars = make(map[string]string)
+		}
+		(*mergedTemplateVars)[k] = v
+	}
+}
+
+// copy returns a copy of the profile whose maps can be modified without modifying the maps of this profile.
+func (p Profile) copy() Profile {
+	copied := p
+	copied.TemplateVars = mergeStringMaps(p.TemplateVars)
+	if p.Builds != nil {
+		copied.Builds = make(map[string]BuildConfig, len(p.Builds))
+		for k, v := range p.Builds {
+			copied.Builds[k] = v
+		}
+	}
+	return copied
+}
+
+func sortedBuildConfigNames(builds map[string]BuildConfig) []string {
+	var names []string
+	for k := range builds {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func copyForVars(in map[string][]string) map[string][]string {
+	if in == nil {
+		return nil
+	}
+	out := make(map[string][]string, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
+
+func sortedForVarNames(forVars map[string][]string) []string {
+	var names []string
+	for k := range forVars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,174 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigInclude(t *testing.T) {
+	for i, tc := range []struct {
+		name      string
+		files     map[string]string
+		wantError string
+		verify    func(t *testing.T, tmpDir string, cfg dockergen.Config, caseNum int, name string)
+	}{
+		{
+			"builds, template variables and for variables of included files are merged",
+			map[string]string{
+				"dockergen.yml": `include:
+  - teams/*.yml
+template-vars:
+  registry: registry.example.com
+builds:
+  root:
+    docker-template: root/Dockerfile_template.txt
+    tag: test/root
+    requires:
+      - app
+`,
+				"teams/a.yml": `template-vars:
+  registry: registry.example.com
+  team: a
+for:
+  jdk:
+    - jdk8
+network: host
+builds:
+  base:
+    docker-template: base/Dockerfile_template.txt
+    tag: test/base
+`,
+				"teams/b.yml": `builds:
+  app:
+    docker-template: app/Dockerfile_template.txt
+    tag: test/app
+    requires:
+      - base
+`,
+			},
+			"",
+			func(t *testing.T, tmpDir string, cfg dockergen.Config, caseNum int, name string) {
+				assert.Equal(t, map[string]string{"registry": "registry.example.com", "team": "a"}, cfg.TemplateVars, "Case %d: %s", caseNum, name)
+				assert.Equal(t, map[string][]string{"jdk": {"jdk8"}}, cfg.For, "Case %d: %s", caseNum, name)
+
+				bParams, err := cfg.BuildParams()
+				require.NoError(t, err, "Case %d: %s", caseNum, name)
+				require.Equal(t, 3, len(bParams), "Case %d: %s", caseNum, name)
+				assert.Equal(t, "root", bParams[0].Name, "Case %d: %s", caseNum, name)
+				assert.Equal(t, path.Join(tmpDir, "root/Dockerfile_template.txt"), bParams[0].DockerfileTemplatePath, "Case %d: %s", caseNum, name)
+				assert.Equal(t, "", bParams[0].BuildOptions.Network, "Case %d: %s", caseNum, name)
+				assert.Equal(t, "base", bParams[1].Name, "Case %d: %s", caseNum, name)
+				assert.Equal(t, path.Join(tmpDir, "teams"), bParams[1].Dir, "Case %d: %s", caseNum, name)
+				assert.Equal(t, path.Join(tmpDir, "teams/base/Dockerfile_template.txt"), bParams[1].DockerfileTemplatePath, "Case %d: %s", caseNum, name)
+				assert.Equal(t, "host", bParams[1].BuildOptions.Network, "Case %d: %s", caseNum, name)
+				assert.Equal(t, "app", bParams[2].Name, "Case %d: %s", caseNum, name)
+				assert.Equal(t, "", bParams[2].BuildOptions.Network, "Case %d: %s", caseNum, name)
+			},
+		},
+		{
+			"conflicting builds and variables are reported with their positions",
+			map[string]string{
+				"dockergen.yml": `include:
+  - other.yml
+tag-suffix: -t1
+template-vars:
+  registry: registry.example.com
+builds:
+  base:
+    tag: test/base
+`,
+				"other.yml": `tag-suffix: -t2
+template-vars:
+  registry: registry2.example.com
+builds:
+  base:
+    tag: test/base2
+`,
+			},
+			"{{tmpDir}}/other.yml:1:1: tag-suffix is \"-t2\", which conflicts with the value \"-t1\" of another configuration file\n" +
+				"{{tmpDir}}/other.yml:3:3: template variable registry is \"registry2.example.com\", which conflicts with the value \"registry.example.com\" of another configuration file\n" +
+				"{{tmpDir}}/other.yml:5:3: build base is already defined in {{tmpDir}}/dockergen.yml",
+			nil,
+		},
+		{
+			"include cycles are errors",
+			map[string]string{
+				"dockergen.yml": `include:
+  - a.yml
+`,
+				"a.yml": `include:
+  - b.yml
+`,
+				"b.yml": `include:
+  - a.yml
+`,
+			},
+			"include cycle exists: {{tmpDir}}/a.yml -> {{tmpDir}}/b.yml -> {{tmpDir}}/a.yml",
+			nil,
+		},
+		{
+			"file included more than once is only loaded once",
+			map[string]string{
+				"dockergen.yml": `include:
+  - a.yml
+  - b.yml
+`,
+				"a.yml": `include:
+  - b.yml
+`,
+				"b.yml": `builds:
+  base:
+    tag: test/base
+`,
+			},
+			"",
+			func(t *testing.T, tmpDir string, cfg dockergen.Config, caseNum int, name string) {
+				bParams, err := cfg.BuildParams()
+				require.NoError(t, err, "Case %d: %s", caseNum, name)
+				assert.Equal(t, 1, len(bParams), "Case %d: %s", caseNum, name)
+			},
+		},
+		{
+			"include pattern that does not match any files is an error",
+			map[string]string{
+				"dockergen.yml": `include:
+  - missing/*.yml
+`,
+			},
+			"include pattern missing/*.yml in {{tmpDir}}/dockergen.yml does not match any files",
+			nil,
+		},
+	} {
+		func() {
+			tmpDir, cleanup, err := dirs.TempDir("", "")
+			defer cleanup()
+			require.NoError(t, err, "Case %d: %s", i, tc.name)
+			for name, content := range tc.files {
+				require.NoError(t, os.MkdirAll(path.Dir(path.Join(tmpDir, name)), 0755), "Case %d: %s", i, tc.name)
+				require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, name), []byte(content), 0644), "Case %d: %s", i, tc.name)
+			}
+
+			cfg, err := dockergen.LoadConfig(path.Join(tmpDir, "dockergen.yml"))
+			if tc.wantError != "" {
+				require.Error(t, err, fmt.Sprintf("Case %d: %s", i, tc.name))
+				assert.Equal(t, strings.Replace(tc.wantError, "{{tmpDir}}", tmpDir, -1), err.Error(), "Case %d: %s", i, tc.name)
+				return
+			}
+			require.NoError(t, err, "Case %d: %s", i, tc.name)
+			tc.verify(t, tmpDir, cfg, i, tc.name)
+		}()
+	}
+}
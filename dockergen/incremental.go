@@ -0,0 +1,249 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// inputHashLabel is the label that records the input hash on images built by incremental builds.
+const inputHashLabel = "dockergen.input-hash"
+
+// buildState is the content of the state file used by incremental builds. It records the input hash of the last
+// successful build of each build iteration.
+type buildState struct {
+	// map from the key of a build iteration (see stateKey) to the state of the iteration
+	Images map[string]buildStateImage `json:"images"`
+}
+
+type buildStateImage struct {
+	// Hash of the inputs of the build.
+	InputHash string `json:"inputHash"`
+	// ID of the image that was built. Empty if the executor cannot inspect images.
+	ImageID string `json:"imageId,omitempty"`
+	// Primary tag of the image that was built.
+	Tag string `json:"tag"`
+}
+
+func readBuildState(path string) (buildState, error) {
+	state := buildState{
+		Images: make(map[string]buildStateImage),
+	}
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, errors.Wrapf(err, "failed to read state file")
+	}
+	if err := json.Unmarshal(bytes, &state); err != nil {
+		return state, errors.Wrapf(err, "failed to parse state file %s", path)
+	}
+	if state.Images == nil {
+		state.Images = make(map[string]buildStateImage)
+	}
+	return state, nil
+}
+
+func (s buildState) writeFile(path string) error {
+	bytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal state")
+	}
+	if err := ioutil.WriteFile(path, append(bytes, '\n'), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write state file")
+	}
+	return nil
+}
+
+// stateKey returns the key that identifies the provided build iteration in the state file. The key does not include
+// the tag because tags typically include the build ID, which differs between runs.
+func stateKey(build string, iterVars map[string]string) string {
+	if len(iterVars) == 0 {
+		return build
+	}
+	return build + " " + formatVars(iterVars)
+}
+
+// incrementalState tracks the input hashes of the units of a run that uses incremental builds. It is safe for
+// concurrent use.
+type incrementalState struct {
+	path  string
+	units []buildUnit
+	deps  [][]int
+
+	mu   sync.Mutex
+	prev buildState
+	next buildState
+	// map from unit index to the input hash of the unit
+	hashes map[int]string
+}
+
+func newIncrementalState(path string, units []buildUnit, deps [][]int) (*incrementalState, error) {
+	prev, err := readBuildState(path)
+	if err != nil {
+		return nil, err
+	}
+	// entries for iterations that are not built by this run are retained
+	next := buildState{
+		Images: make(map[string]buildStateImage, len(prev.Images)),
+	}
+	for k, v := range prev.Images {
+		next.Images[k] = v
+	}
+	return &incrementalState{
+		path:   path,
+		units:  units,
+		deps:   deps,
+		prev:   prev,
+		next:   next,
+		hashes: make(map[int]string),
+	}, nil
+}
+
+// previous returns the state recorded for the provided unit by the previous run.
+func (s *incrementalState) previous(unitIdx int) (buildStateImage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unit := s.units[unitIdx]
+	image, ok := s.prev.Images[stateKey(unit.build.Name, unit.iterVars)]
+	return image, ok
+}
+
+// setHash sets the input hash of the provided unit. Must be called before any unit that depends on the unit computes
+// its hash.
+func (s *incrementalState) setHash(unitIdx int, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hashes[unitIdx] = hash
+}
+
+// record records the image built for the provided unit so that it is written to the state file.
+func (s *incrementalState) record(unitIdx int, image buildStateImage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unit := s.units[unitIdx]
+	s.next.Images[stateKey(unit.build.Name, unit.iterVars)] = image
+}
+
+func (s *incrementalState) writeFile() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next.writeFile(s.path)
+}
+
+// inputHash returns the hash of the inputs of the provided unit: the rendered Dockerfile and .dockerignore, the
+// rendered build options, the files in the build context that are not excluded by the .dockerignore and the input
+// hashes of the units that the unit depends on. The tags of the units that the unit depends on are replaced by their
+// input hashes in the rendered values so that the hash does not change when only the build ID changes.
+func (s *incrementalState) inputHash(unitIdx int, dockerfile, dockerignore string, buildOptions DockerBuildOptions, contextDir string) (string, error) {
+	s.mu.Lock()
+	var depHashes []string
+	var replacements []string
+	for _, dep := range s.deps[unitIdx] {
+		depHash, ok := s.hashes[dep]
+		if !ok {
+			s.mu.Unlock()
+			return "", errors.Errorf("input hash of %s was not computed", s.units[dep].tag)
+		}
+		depHashes = append(depHashes, depHash)
+		for _, tag := range append([]string{s.units[dep].tag}, s.units[dep].additionalTags...) {
+			replacements = append(replacements, tag, "sha256:"+depHash)
+		}
+	}
+	s.mu.Unlock()
+
+	// longer tags are replaced first so that a tag that is a prefix of another tag does not replace part of it
+	replacements = sortReplacements(replacements)
+	replacer := strings.NewReplacer(replacements...)
+
+	h := sha256.New()
+	writeHashField(h, "dockerfile", replacer.Replace(dockerfile))
+	writeHashField(h, "dockerignore", replacer.Replace(dockerignore))
+	for _, arg := range buildOptions.args() {
+		writeHashField(h, "option", replacer.Replace(arg))
+	}
+	for _, depHash := range depHashes {
+		writeHashField(h, "dependency", depHash)
+	}
+	if err := hashContext(h, contextDir, dockerignore); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sortReplacements sorts the provided old/new string pairs in descending order of the length of the old string.
+func sortReplacements(replacements []string) []string {
+	var pairs [][2]string
+	for i := 0; i+1 < len(replacements); i += 2 {
+		pairs = append(pairs, [2]string{replacements[i], replacements[i+1]})
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return len(pairs[i][0]) > len(pairs[j][0])
+	})
+	var sorted []string
+	for _, pair := range pairs {
+		sorted = append(sorted, pair[0], pair[1])
+	}
+	return sorted
+}
+
+func writeHashField(w io.Writer, name, value string) {
+	_, _ = fmt.Fprintf(w, "%s %d\n%s\n", name, len(value), value)
+}
+
+// hashContext writes the paths, modes and contents of the files in the provided build context directory that are not
+// excluded by the provided .dockerignore content to the provided hash. If dockerignore is empty, the .dockerignore file
+// in the context directory is used.
+func hashContext(w io.Writer, contextDir, dockerignoreContent string) error {
+	var ignore *dockerignore
+	var err error
+	if dockerignoreContent != "" {
+		ignore, err = parseDockerignore(strings.NewReader(dockerignoreContent))
+	} else {
+		ignore, err = readDockerignore(contextDir)
+	}
+	if err != nil {
+		return err
+	}
+	if err := walkContext(contextDir, ignore, nil, func(relPath, absPath string, info os.FileInfo) error {
+		writeHashField(w, "path", relPath)
+		writeHashField(w, "mode", info.Mode().String())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(absPath)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			writeHashField(w, "link", link)
+		case info.Mode().IsRegular():
+			f, err := os.Open(absPath)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			_, _ = fmt.Fprintf(w, "content %d\n", info.Size())
+			if _, err := io.Copy(w, f); err != nil {
+				return errors.Wrapf(err, "failed to read %s", absPath)
+			}
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "failed to hash build context %s", contextDir)
+	}
+	return nil
+}
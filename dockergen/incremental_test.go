@@ -0,0 +1,141 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestIncrementalBuild(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+
+	for name, content := range map[string]string{
+		"base/Dockerfile_template.txt": "FROM scratch\nCOPY a.txt /\n",
+		"base/a.txt":                   "a",
+		"base/ignored.txt":             "ignored",
+		"base/.dockerignore":           "ignored.txt\n",
+		"app/Dockerfile_template.txt":  "FROM {{Tag \"base\" 0 0}}\n",
+	} {
+		require.NoError(t, os.MkdirAll(path.Dir(path.Join(tmpDir, name)), 0755))
+		require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, name), []byte(content), 0644))
+	}
+
+	var cfg dockergen.Config
+	err = yaml.Unmarshal([]byte(`
+build-id-var: DOCKERGEN_INCREMENTAL_TEST_BUILD_ID
+builds:
+  base:
+    docker-template: base/Dockerfile_template.txt
+    tag: test/base
+  app:
+    docker-template: app/Dockerfile_template.txt
+    tag: test/app
+    requires:
+      - base
+`), &cfg)
+	require.NoError(t, err)
+	cfg.Dir = tmpDir
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	for i, tc := range []struct {
+		name    string
+		buildID string
+		files   map[string]string
+		want    []string
+	}{
+		{
+			"first build builds all images",
+			"1",
+			nil,
+			[]string{
+				"build test/base-1",
+				"build test/app-1",
+			},
+		},
+		{
+			"unchanged images are not rebuilt",
+			"1",
+			nil,
+			nil,
+		},
+		{
+			"unchanged images are tagged with new tags",
+			"2",
+			nil,
+			[]string{
+				"tag test/base-1 test/base-2",
+				"tag test/app-1 test/app-2",
+			},
+		},
+		{
+			"change to ignored file does not rebuild images",
+			"2",
+			map[string]string{
+				"base/ignored.txt": "changed",
+			},
+			nil,
+		},
+		{
+			"change to context of required image rebuilds dependent images",
+			"2",
+			map[string]string{
+				"base/a.txt": "changed",
+			},
+			[]string{
+				"build test/base-2",
+				"build test/app-2",
+			},
+		},
+		{
+			"change to template rebuilds only that image",
+			"2",
+			map[string]string{
+				"app/Dockerfile_template.txt": "FROM {{Tag \"base\" 0 0}}\nLABEL changed=true\n",
+			},
+			[]string{
+				"build test/app-2",
+			},
+		},
+	} {
+		for name, content := range tc.files {
+			require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, name), []byte(content), 0644), "Case %d: %s", i, tc.name)
+		}
+		require.NoError(t, os.Setenv("DOCKERGEN_INCREMENTAL_TEST_BUILD_ID", tc.buildID))
+
+		executor := &recordingExecutor{}
+		params := cfg.ToParams()
+		params.TagSuffix = "-{{BuildID}}"
+		params.StateFile = path.Join(tmpDir, "state.json")
+		err := dockergen.Build(map[string]dockergen.Executor{"base": executor, "app": executor}, bParams, params, ioutil.Discard)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		var got []string
+		for _, command := range executor.commands {
+			switch command[1] {
+			case "build":
+				got = append(got, "build "+command[3])
+				// the input hash is recorded as a label of the image
+				assert.Contains(t, strings.Join(command, " "), "--label dockergen.input-hash=", "Case %d: %s", i, tc.name)
+			default:
+				got = append(got, strings.Join(command[1:], " "))
+			}
+		}
+		assert.Equal(t, tc.want, got, "Case %d: %s", i, tc.name)
+	}
+	require.NoError(t, os.Unsetenv("DOCKERGEN_INCREMENTAL_TEST_BUILD_ID"))
+}
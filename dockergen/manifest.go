@@ -0,0 +1,80 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Manifest records the images that were built or pushed by a run.
+type Manifest struct {
+	Images []ManifestImage `json:"images"`
+}
+
+// ManifestImage records a single image that was built or pushed.
+type ManifestImage struct {
+	// Name of the build that produced the image.
+	Build string `json:"build"`
+	// Values of the "for" variables for the iteration that produced the image.
+	Vars map[string]string `json:"vars,omitempty"`
+	// Rendered primary tag of the image.
+	Tag string `json:"tag"`
+	// Rendered tags of the image other than the primary tag, including aliases.
+	AdditionalTags []string `json:"additionalTags,omitempty"`
+	// ID of the image. Empty if the executor cannot inspect images.
+	ImageID string `json:"imageId,omitempty"`
+	// Registry digest of the image in the repository of the primary tag. Only set for images that were pushed.
+	Digest string `json:"digest,omitempty"`
+}
+
+// WriteFile writes the manifest as JSON to the file at the provided path.
+func (m Manifest) WriteFile(path string) error {
+	bytes, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal manifest")
+	}
+	if err := ioutil.WriteFile(path, append(bytes, '\n'), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write manifest")
+	}
+	return nil
+}
+
+// manifestRecorder records the images for the units of a run. It is safe for concurrent use.
+type manifestRecorder struct {
+	mu     sync.Mutex
+	images map[int]ManifestImage
+}
+
+func (r *manifestRecorder) record(unitIdx int, image ManifestImage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.images == nil {
+		r.images = make(map[int]ManifestImage)
+	}
+	r.images[unitIdx] = image
+}
+
+// manifest returns a manifest that contains the recorded images in unit order.
+func (r *manifestRecorder) manifest() Manifest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unitIdxs []int
+	for idx := range r.images {
+		unitIdxs = append(unitIdxs, idx)
+	}
+	sort.Ints(unitIdxs)
+	m := Manifest{
+		Images: []ManifestImage{},
+	}
+	for _, idx := range unitIdxs {
+		m.Images = append(m.Images, r.images[idx])
+	}
+	return m
+}
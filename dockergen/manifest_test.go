@@ -0,0 +1,164 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+// inspectingExecutor is a no-op executor that reports an image ID and repository digest derived from the reference of
+// the inspected image.
+type inspectingExecutor struct{}
+
+func (e inspectingExecutor) Run(w io.Writer, name string, args ...string) error {
+	return nil
+}
+
+func (e inspectingExecutor) InspectImage(w io.Writer, ref string) (dockergen.ImageInfo, error) {
+	repo := ref[:strings.LastIndex(ref, ":")]
+	return dockergen.ImageInfo{
+		ID: "sha256:id-" + ref,
+		RepoDigests: []string{
+			"other/repo@sha256:other",
+			repo + "@sha256:digest-" + ref,
+		},
+	}, nil
+}
+
+func TestManifest(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(path.Join(tmpDir, "Dockerfile_template.txt"), []byte("FROM scratch\n"), 0644)
+	require.NoError(t, err)
+
+	yml := strings.Replace(`
+tag-suffix: -t1
+builds:
+  foo:
+    docker-template: Dockerfile_template.txt
+    tag: test/foo:{{.version}}
+    for:
+      version:
+        - "1"
+        - "2"
+`, "Dockerfile_template.txt", path.Join(tmpDir, "Dockerfile_template.txt"), -1)
+
+	var cfg dockergen.Config
+	err = yaml.Unmarshal([]byte(yml), &cfg)
+	require.NoError(t, err)
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+	executors := map[string]dockergen.Executor{
+		"foo": inspectingExecutor{},
+	}
+
+	for i, tc := range []struct {
+		name   string
+		action func(map[string]dockergen.Executor, []dockergen.BuildParams, dockergen.Params, io.Writer) error
+		want   dockergen.Manifest
+	}{
+		{
+			"build records image IDs",
+			dockergen.Build,
+			dockergen.Manifest{
+				Images: []dockergen.ManifestImage{
+					{Build: "foo", Vars: map[string]string{"version": "1"}, Tag: "test/foo:1-t1", ImageID: "sha256:id-test/foo:1-t1"},
+					{Build: "foo", Vars: map[string]string{"version": "2"}, Tag: "test/foo:2-t1", ImageID: "sha256:id-test/foo:2-t1"},
+				},
+			},
+		},
+		{
+			"push records digests",
+			dockergen.Push,
+			dockergen.Manifest{
+				Images: []dockergen.ManifestImage{
+					{Build: "foo", Vars: map[string]string{"version": "1"}, Tag: "test/foo:1-t1", ImageID: "sha256:id-test/foo:1-t1", Digest: "sha256:digest-test/foo:1-t1"},
+					{Build: "foo", Vars: map[string]string{"version": "2"}, Tag: "test/foo:2-t1", ImageID: "sha256:id-test/foo:2-t1", Digest: "sha256:digest-test/foo:2-t1"},
+				},
+			},
+		},
+	} {
+		params := cfg.ToParams()
+		params.ManifestPath = path.Join(tmpDir, "manifest.json")
+
+		err := tc.action(executors, bParams, params, ioutil.Discard)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		bytes, err := ioutil.ReadFile(params.ManifestPath)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		var got dockergen.Manifest
+		err = json.Unmarshal(bytes, &got)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.want, got, "Case %d: %s", i, tc.name)
+	}
+}
+
+func TestManifestOnlyRecordsProcessedImages(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+
+	var cfg dockergen.Config
+	require.NoError(t, yaml.Unmarshal([]byte(whereYML), &cfg))
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	for i, tc := range []struct {
+		name      string
+		executors map[string]dockergen.Executor
+		where     map[string][]string
+		want      []string
+	}{
+		{
+			"images of builds with no-op executors are not recorded",
+			map[string]dockergen.Executor{"base": dockergen.NoopExecutor(), "app": inspectingExecutor{}, "other": inspectingExecutor{}},
+			nil,
+			[]string{
+				"test/app:jdk7-amd64-t1",
+				"test/app:jdk7-arm64-t1",
+				"test/other:jdk7-t1",
+				"test/app:jdk8-amd64-t1",
+				"test/app:jdk8-arm64-t1",
+				"test/other:jdk8-t1",
+			},
+		},
+		{
+			"images of dependencies run by the dependency executor are not recorded",
+			map[string]dockergen.Executor{"base": inspectingExecutor{}, "app": inspectingExecutor{}, "other": inspectingExecutor{}},
+			map[string][]string{"jdk": {"jdk8"}, "arch": {"amd64"}},
+			[]string{"test/app:jdk8-amd64-t1"},
+		},
+	} {
+		params := cfg.ToParams()
+		params.ManifestPath = path.Join(tmpDir, "manifest.json")
+		params.Where = tc.where
+		params.DependencyExecutor = inspectingExecutor{}
+		err = dockergen.Push(tc.executors, bParams, params, ioutil.Discard)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		bytes, err := ioutil.ReadFile(params.ManifestPath)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		var manifest dockergen.Manifest
+		require.NoError(t, json.Unmarshal(bytes, &manifest), "Case %d: %s", i, tc.name)
+		var got []string
+		for _, image := range manifest.Images {
+			got = append(got, image.Tag)
+		}
+		assert.Equal(t, tc.want, got, "Case %d: %s", i, tc.name)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Matrix specifies variables whose values are combined as a cartesian product: every combination of the values of the
+// variables is an iteration. In YAML, a matrix is specified as a map from variable names to the list of values for the
+// variable. The reserved keys "exclude" and "include" specify lists of combinations that are removed from or added to
+// the product.
+type Matrix struct {
+	// Values for each of the variables in the matrix.
+	Vars map[string][]string `yaml:",inline"`
+	// Combinations that are removed from the product. An entry matches a combination if every variable in the entry
+	// has the same value in the combination.
+	Exclude []map[string]string `yaml:"exclude"`
+	// Combinations that are added to the product after exclusions are applied. Each entry must specify a value for
+	// every variable in the matrix.
+	Include []map[string]string `yaml:"include"`
+}
+
+// VarNames returns the sorted names of the variables in the matrix.
+func (m *Matrix) VarNames() []string {
+	var names []string
+	for k := range m.Vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate returns an error if the matrix is not valid. A matrix is valid if it has at least one variable, every
+// variable has at least one value, every exclude entry only refers to variables in the matrix and every include entry
+// specifies a value for exactly the variables in the matrix.
+func (m *Matrix) Validate() error {
+	if len(m.Vars) == 0 {
+		return errors.Errorf("matrix must specify at least one variable")
+	}
+	varNames := m.VarNames()
+	for _, name := range varNames {
+		if len(m.Vars[name]) == 0 {
+			return errors.Errorf("matrix variable %s must have at least one value", name)
+		}
+	}
+	for i, entry := range m.Exclude {
+		for k := range entry {
+			if _, ok := m.Vars[k]; !ok {
+				return errors.Errorf("matrix exclude entry %d refers to unknown variable %s (valid variables: %v)", i, k, varNames)
+			}
+		}
+	}
+	for i, entry := range m.Include {
+		var entryVarNames []string
+		for k := range entry {
+			entryVarNames = append(entryVarNames, k)
+		}
+		sort.Strings(entryVarNames)
+		if strings.Join(entryVarNames, ",") != strings.Join(varNames, ",") {
+			return errors.Errorf("matrix include entry %d must specify exactly the matrix variables %v, was %v", i, varNames, entryVarNames)
+		}
+	}
+	return nil
+}
+
+// combinations returns the combinations of the matrix. The product is ordered such that the values of variables whose
+// names sort later change fastest. Included combinations that are not already present are appended in order.
+func (m *Matrix) combinations() []map[string]string {
+	combinations := []map[string]string{{}}
+	for _, name := range m.VarNames() {
+		var next []map[string]string
+		for _, combination := range combinations {
+			for _, val := range m.Vars[name] {
+				newCombination := make(map[string]string, len(combination)+1)
+				for k, v := range combination {
+					newCombination[k] = v
+				}
+				newCombination[name] = val
+				next = append(next, newCombination)
+			}
+		}
+		combinations = next
+	}
+
+	var output []map[string]string
+	for _, combination := range combinations {
+		if !matchesAny(combination, m.Exclude) {
+			output = append(output, combination)
+		}
+	}
+	for _, include := range m.Include {
+		if !matchesAny(include, output) {
+			output = append(output, include)
+		}
+	}
+	return output
+}
+
+// matchesAny returns true if any of the provided entries matches the provided combination. An entry matches a
+// combination if every key in the entry has the same value in the combination.
+func matchesAny(combination map[string]string, entries []map[string]string) bool {
+	for _, entry := range entries {
+		matches := true
+		for k, v := range entry {
+			if combination[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// loop is the set of iterations defined by a "for" or "matrix" block. Each iteration maps the names of the variables
+// of the loop to their (unrendered) values.
+type loop struct {
+	varNames   []string
+	iterations []map[string]string
+}
+
+// newLoop returns the loop for the provided "for" variables and matrix. At most one of them may be non-empty. If both
+// are empty, the loop has a single iteration with no variables.
+func newLoop(forVars map[string][]string, matrix *Matrix) loop {
+	if matrix != nil {
+		return loop{
+			varNames:   matrix.VarNames(),
+			iterations: matrix.combinations(),
+		}
+	}
+	if len(forVars) == 0 {
+		return loop{
+			iterations: []map[string]string{{}},
+		}
+	}
+
+	var sortedForVarNames []string
+	for k := range forVars {
+		sortedForVarNames = append(sortedForVarNames, k)
+	}
+	sort.Strings(sortedForVarNames)
+
+	var iterations []map[string]string
+	for i := 0; i < len(forVars[sortedForVarNames[0]]); i++ {
+		iteration := make(map[string]string)
+		for _, varName := range sortedForVarNames {
+			iteration[varName] = forVars[varName][i]
+		}
+		iterations = append(iterations, iteration)
+	}
+	return loop{
+		varNames:   sortedForVarNames,
+		iterations: iterations,
+	}
+}
+
+// hasVar returns true if the provided name is the name of a variable of the loop.
+func (l loop) hasVar(name string) bool {
+	for _, varName := range l.varNames {
+		if varName == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestMatrixTags(t *testing.T) {
+	for i, tc := range []struct {
+		name string
+		yml  string
+		want string
+	}{
+		{
+			"outer matrix is cartesian product",
+			`
+matrix:
+  jdk:
+    - jdk7
+    - jdk8
+  distro:
+    - alpine
+    - debian
+builds:
+  foo:
+    tag: test/foo:{{.jdk}}-{{.distro}}
+`,
+			`test/foo:jdk7-alpine-unspecified
+test/foo:jdk8-alpine-unspecified
+test/foo:jdk7-debian-unspecified
+test/foo:jdk8-debian-unspecified
+`,
+		},
+		{
+			"inner matrix with exclude and include",
+			`
+builds:
+  foo:
+    tag: test/foo:{{.jdk}}-{{.distro}}
+    matrix:
+      jdk:
+        - jdk7
+        - jdk8
+      distro:
+        - alpine
+        - debian
+      exclude:
+        - jdk: jdk7
+          distro: debian
+      include:
+        - jdk: jdk11
+          distro: alpine
+        - jdk: jdk8
+          distro: alpine
+`,
+			`test/foo:jdk7-alpine-unspecified
+test/foo:jdk8-alpine-unspecified
+test/foo:jdk8-debian-unspecified
+test/foo:jdk11-alpine-unspecified
+`,
+		},
+		{
+			"exclude can match on a subset of variables",
+			`
+builds:
+  foo:
+    tag: test/foo:{{.jdk}}-{{.distro}}
+    matrix:
+      jdk:
+        - jdk7
+        - jdk8
+      distro:
+        - alpine
+        - debian
+      exclude:
+        - jdk: jdk7
+`,
+			`test/foo:jdk8-alpine-unspecified
+test/foo:jdk8-debian-unspecified
+`,
+		},
+	} {
+		var cfg dockergen.Config
+		err := yaml.Unmarshal([]byte(tc.yml), &cfg)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		bParams, err := cfg.BuildParams()
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		buf := &bytes.Buffer{}
+		err = dockergen.Tags(nil, bParams, cfg.ToParams(), buf)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.want, buf.String(), "Case %d: %s", i, tc.name)
+	}
+}
+
+func TestInvalidMatrix(t *testing.T) {
+	for i, tc := range []struct {
+		name      string
+		yml       string
+		wantError string
+	}{
+		{
+			"for and matrix cannot both be specified",
+			`
+builds:
+  foo:
+    tag: test/foo
+    for:
+      jdk:
+        - jdk7
+    matrix:
+      distro:
+        - alpine
+`,
+			"'for' and 'matrix' cannot both be specified",
+		},
+		{
+			"exclude must refer to matrix variables",
+			`
+builds:
+  foo:
+    tag: test/foo
+    matrix:
+      jdk:
+        - jdk7
+      exclude:
+        - distro: alpine
+`,
+			`matrix exclude entry 0 refers to unknown variable distro \(valid variables: \[jdk\]\)`,
+		},
+		{
+			"include must specify all matrix variables",
+			`
+builds:
+  foo:
+    tag: test/foo
+    matrix:
+      jdk:
+        - jdk7
+      distro:
+        - alpine
+      include:
+        - jdk: jdk8
+`,
+			`matrix include entry 0 must specify exactly the matrix variables \[distro jdk\], was \[jdk\]`,
+		},
+	} {
+		var cfg dockergen.Config
+		err := yaml.Unmarshal([]byte(tc.yml), &cfg)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		_, err = cfg.BuildParams()
+		require.Error(t, err, fmt.Sprintf("Case %d: %s", i, tc.name))
+		assert.Regexp(t, tc.wantError, err.Error(), "Case %d: %s", i, tc.name)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// VarOverrides are overrides for the variables of a configuration, which are typically specified on the command line.
+// Template variables are determined in order of increasing precedence by the configuration, the variable files (in
+// order) and Set.
+type VarOverrides struct {
+	// Paths of YAML files that map template variable names to values. Variables in later files take precedence.
+	VarFiles []string
+	// Template variables that are set. Take precedence over the variables in the variable files.
+	Set map[string]string
+	// Values to which "for" and "matrix" variables are narrowed. Every key must be the name of a "for" or "matrix"
+	// variable of the configuration or of one of its builds, and every value must be one of the values of that variable.
+	// Only the iterations of the loops that define the variable in which the variable has one of the provided values are
+	// run.
+	For map[string][]string
+}
+
+// WithVarOverrides returns a copy of the configuration with the provided overrides applied. Returns an error if a
+// variable file cannot be read or decoded or if a "for" override refers to a variable or value that is not defined or
+// narrows a loop such that it has no iterations. The returned configuration is otherwise not validated: conflicts between
+// the overridden template variables and "for" variables are reported by Params.Validate.
+func (c Config) WithVarOverrides(overrides VarOverrides) (Config, error) {
+	applied := c
+	templateVars := []map[string]string{c.TemplateVars}
+	for _, path := range overrides.VarFiles {
+		vars, err := loadVarFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		templateVars = append(templateVars, vars)
+	}
+	applied.TemplateVars = mergeStringMaps(append(templateVars, overrides.Set)...)
+
+	if len(overrides.For) == 0 {
+		return applied, nil
+	}
+	narrowed := make(map[string]struct{})
+	var err error
+	if applied.For, applied.Matrix, err = narrowLoop(c.For, c.Matrix, overrides.For, narrowed); err != nil {
+		return Config{}, errors.Wrapf(err, "invalid 'for' override")
+	}
+	applied.Builds = nil
+	for _, item := range c.Builds {
+		build := item.Value.(BuildConfig)
+		if build.For, build.Matrix, err = narrowLoop(build.For, build.Matrix, overrides.For, narrowed); err != nil {
+			return Config{}, errors.Wrapf(err, "invalid 'for' override for build %s", item.Key)
+		}
+		applied.Builds = append(applied.Builds, yamlv2.MapItem{
+			Key:   item.Key,
+			Value: build,
+		})
+	}
+
+	var undefined []string
+	for k := range overrides.For {
+		if _, ok := narrowed[k]; !ok {
+			undefined = append(undefined, k)
+		}
+	}
+	if len(undefined) != 0 {
+		sort.Strings(undefined)
+		return Config{}, errors.Errorf("'for' overrides refer to variables that are not 'for' or 'matrix' variables in configuration: %v", undefined)
+	}
+	return applied, nil
+}
+
+// loadVarFile returns the template variables in the variable file at the provided path. The file must be a YAML map
+// from variable names to values. If the file cannot be decoded, the returned error is a *ConfigError.
+func loadVarFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read variable file")
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, &ConfigError{
+			Path:   path,
+			Errors: yamlErrors(err, nil),
+		}
+	}
+	var vars map[string]string
+	if node.Kind != 0 {
+		if err := node.Decode(&vars); err != nil {
+			return nil, &ConfigError{
+				Path:   path,
+				Errors: yamlErrors(err, &node),
+			}
+		}
+	}
+	return vars, nil
+}
+
+// narrowLoop returns copies of the provided "for" variables and matrix that only contain the iterations in which the
+// variables that are keys of the provided values have one of the provided values. The names of the variables that are
+// defined by the loop are added to the provided set. Returns the provided loop unmodified if it does not define any of
+// the variables.
+func narrowLoop(forVars map[string][]string, matrix *Matrix, values map[string][]string, narrowed map[string]struct{}) (map[string][]string, *Matrix, error) {
+	if matrix != nil {
+		narrowedMatrix, err := narrowMatrix(matrix, values, narrowed)
+		return forVars, narrowedMatrix, err
+	}
+
+	var keep []bool
+	for _, varName := range sortedForVarNames(forVars) {
+		allowed, ok := values[varName]
+		if !ok {
+			continue
+		}
+		narrowed[varName] = struct{}{}
+		if err := verifyValuesDefined(varName, allowed, forVars[varName]); err != nil {
+			return nil, nil, err
+		}
+		if keep == nil {
+			for range forVars[varName] {
+				keep = append(keep, true)
+			}
+		}
+		for i, val := range forVars[varName] {
+			keep[i] = keep[i] && containsString(allowed, val)
+		}
+	}
+	if keep == nil {
+		return forVars, nil, nil
+	}
+	if !containsBool(keep, true) {
+		return nil, nil, errors.Errorf("no iteration of 'for' variables %v matches %s", sortedForVarNames(forVars), formatForValues(values))
+	}
+
+	narrowedVars := make(map[string][]string, len(forVars))
+	for k, vals := range forVars {
+		var narrowedVals []string
+		for i, val := range vals {
+			if keep[i] {
+				narrowedVals = append(narrowedVals, val)
+			}
+		}
+		narrowedVars[k] = narrowedVals
+	}
+	return narrowedVars, nil, nil
+}
+
+// narrowMatrix returns a copy of the provided matrix whose variables only have the provided values. Include entries in
+// which a narrowed variable does not have one of the provided values are removed.
+func narrowMatrix(matrix *Matrix, values map[string][]string, narrowed map[string]struct{}) (*Matrix, error) {
+	narrowedMatrix := *matrix
+	narrowedMatrix.Vars = make(map[string][]string, len(matrix.Vars))
+	for k, v := range matrix.Vars {
+		narrowedMatrix.Vars[k] = v
+	}
+	narrowedMatrix.Include = nil
+
+	modified := false
+	for _, varName := range matrix.VarNames() {
+		allowed, ok := values[varName]
+		if !ok {
+			continue
+		}
+		narrowed[varName] = struct{}{}
+		modified = true
+		if err := verifyValuesDefined(varName, allowed, matrix.Vars[varName]); err != nil {
+			return nil, err
+		}
+		var vals []string
+		for _, val := range matrix.Vars[varName] {
+			if containsString(allowed, val) {
+				vals = append(vals, val)
+			}
+		}
+		narrowedMatrix.Vars[varName] = vals
+	}
+	if !modified {
+		return matrix, nil
+	}
+
+	for _, include := range matrix.Include {
+		matches := true
+		for k, v := range include {
+			if allowed, ok := values[k]; ok && !containsString(allowed, v) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			narrowedMatrix.Include = append(narrowedMatrix.Include, include)
+		}
+	}
+	if len(narrowedMatrix.combinations()) == 0 {
+		return nil, errors.Errorf("no combination of 'matrix' variables %v matches %s", matrix.VarNames(), formatForValues(values))
+	}
+	return &narrowedMatrix, nil
+}
+
+// verifyValuesDefined returns an error if any of the provided values is not one of the defined values of the variable
+// with the provided name.
+func verifyValuesDefined(varName string, values, defined []string) error {
+	for _, val := range values {
+		if !containsString(defined, val) {
+			return errors.Errorf("%s is not a value of variable %s. Valid values: %v", val, varName, defined)
+		}
+	}
+	return nil
+}
+
+func containsBool(vals []bool, val bool) bool {
+	for _, curr := range vals {
+		if curr == val {
+			return true
+		}
+	}
+	return false
+}
+
+// formatForValues returns a description of the provided variable values of the form "a=[1 2], b=[3]".
+func formatForValues(values map[string][]string) string {
+	var parts []string
+	for _, k := range sortedForVarNames(values) {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, values[k]))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,211 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestWithVarOverrides(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+
+	firstVarFile := path.Join(tmpDir, "first.yml")
+	require.NoError(t, ioutil.WriteFile(firstVarFile, []byte("registry: first.example.com\nowner: first\n"), 0644))
+	secondVarFile := path.Join(tmpDir, "second.yml")
+	require.NoError(t, ioutil.WriteFile(secondVarFile, []byte("owner: second\n"), 0644))
+	invalidVarFile := path.Join(tmpDir, "invalid.yml")
+	require.NoError(t, ioutil.WriteFile(invalidVarFile, []byte("owner: [a, b]\n"), 0644))
+
+	for i, tc := range []struct {
+		name      string
+		yml       string
+		overrides dockergen.VarOverrides
+		want      string
+		wantError string
+	}{
+		{
+			"--set takes precedence over variable files, which take precedence over the configuration",
+			`
+template-vars:
+  registry: config.example.com
+  owner: config
+  repo: foo
+builds:
+  foo:
+    tag: "{{.registry}}/{{.owner}}/{{.repo}}"
+`,
+			dockergen.VarOverrides{
+				VarFiles: []string{firstVarFile, secondVarFile},
+				Set:      map[string]string{"registry": "set.example.com"},
+			},
+			"set.example.com/second/foo-unspecified\n",
+			"",
+		},
+		{
+			"outer 'for' is narrowed and the other variables of the remaining iterations are kept",
+			`
+for:
+  jdk:
+    - jdk7
+    - jdk8
+    - jdk11
+  base:
+    - alpine3.5
+    - alpine3.6
+    - alpine3.7
+builds:
+  foo:
+    tag: test/foo:{{.jdk}}-{{.base}}
+`,
+			dockergen.VarOverrides{
+				For: map[string][]string{"jdk": {"jdk11", "jdk8"}},
+			},
+			"test/foo:jdk8-alpine3.6-unspecified\ntest/foo:jdk11-alpine3.7-unspecified\n",
+			"",
+		},
+		{
+			"matrix and build 'for' are narrowed",
+			`
+matrix:
+  jdk:
+    - jdk7
+    - jdk8
+  distro:
+    - alpine
+    - debian
+  include:
+    - jdk: jdk11
+      distro: alpine
+builds:
+  foo:
+    tag: test/foo:{{.jdk}}-{{.distro}}-{{.arch}}
+    for:
+      arch:
+        - amd64
+        - arm64
+`,
+			dockergen.VarOverrides{
+				For: map[string][]string{"distro": {"alpine"}, "arch": {"arm64"}},
+			},
+			"test/foo:jdk7-alpine-arm64-unspecified\ntest/foo:jdk8-alpine-arm64-unspecified\ntest/foo:jdk11-alpine-arm64-unspecified\n",
+			"",
+		},
+		{
+			"narrowing to a value that is not defined is an error",
+			`
+for:
+  jdk:
+    - jdk7
+builds:
+  foo:
+    tag: test/foo:{{.jdk}}
+`,
+			dockergen.VarOverrides{
+				For: map[string][]string{"jdk": {"jdk9"}},
+			},
+			"",
+			"invalid 'for' override: jdk9 is not a value of variable jdk. Valid values: [jdk7]",
+		},
+		{
+			"narrowing a variable that is not defined is an error",
+			`
+for:
+  jdk:
+    - jdk7
+builds:
+  foo:
+    tag: test/foo:{{.jdk}}
+`,
+			dockergen.VarOverrides{
+				For: map[string][]string{"distro": {"alpine"}, "arch": {"amd64"}},
+			},
+			"",
+			"'for' overrides refer to variables that are not 'for' or 'matrix' variables in configuration: [arch distro]",
+		},
+		{
+			"narrowing a loop such that it has no iterations is an error",
+			`
+for:
+  jdk:
+    - jdk7
+    - jdk8
+  base:
+    - alpine3.5
+    - alpine3.6
+builds:
+  foo:
+    tag: test/foo:{{.jdk}}-{{.base}}
+`,
+			dockergen.VarOverrides{
+				For: map[string][]string{"jdk": {"jdk7"}, "base": {"alpine3.6"}},
+			},
+			"",
+			"invalid 'for' override: no iteration of 'for' variables [base jdk] matches base=[alpine3.6], jdk=[jdk7]",
+		},
+		{
+			"variable file that is not a map of strings is an error",
+			`
+builds:
+  foo:
+    tag: test/foo
+`,
+			dockergen.VarOverrides{
+				VarFiles: []string{invalidVarFile},
+			},
+			"",
+			invalidVarFile + ":1:8: cannot unmarshal !!seq into string",
+		},
+		{
+			"template variable that is set for a 'for' variable is reported by Params.Validate",
+			`
+for:
+  jdk:
+    - jdk7
+builds:
+  foo:
+    tag: test/foo:{{.jdk}}
+`,
+			dockergen.VarOverrides{
+				Set: map[string]string{"jdk": "jdk8"},
+			},
+			"",
+			"invalid Docker generator params: the following variables were defined as both template and for variables: [jdk]",
+		},
+	} {
+		var cfg dockergen.Config
+		require.NoError(t, yaml.Unmarshal([]byte(tc.yml), &cfg), "Case %d: %s", i, tc.name)
+
+		applied, err := cfg.WithVarOverrides(tc.overrides)
+		if err == nil {
+			var bParams []dockergen.BuildParams
+			bParams, err = applied.BuildParams()
+			require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+			buf := &bytes.Buffer{}
+			err = dockergen.Tags(nil, bParams, applied.ToParams(), buf)
+			if err == nil {
+				assert.Equal(t, tc.want, buf.String(), "Case %d: %s", i, tc.name)
+			}
+		}
+		if tc.wantError != "" {
+			require.Error(t, err, fmt.Sprintf("Case %d: %s", i, tc.name))
+			assert.EqualError(t, err, tc.wantError, "Case %d: %s", i, tc.name)
+			continue
+		}
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// loadPartials reads the partials matched by the provided paths or glob patterns and returns a map from the name of each
+// partial to its content. The name of a partial is the name of its file without the extension. Returns an error if a
+// pattern does not match any files or if files in different directories define partials with the same name.
+func loadPartials(patterns []string) (map[string]string, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	partials := make(map[string]string)
+	partialPaths := make(map[string]string)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid partials pattern %s", pattern)
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("partials pattern %s does not match any files", pattern)
+		}
+		for _, match := range matches {
+			name := strings.TrimSuffix(filepath.Base(match), filepath.Ext(match))
+			if otherPath, ok := partialPaths[name]; ok {
+				if filepath.Clean(otherPath) == filepath.Clean(match) {
+					continue
+				}
+				return nil, errors.Errorf("partial %s is defined by both %s and %s", name, otherPath, match)
+			}
+			content, err := ioutil.ReadFile(match)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read partial")
+			}
+			partials[name] = string(content)
+			partialPaths[name] = match
+		}
+	}
+	return partials, nil
+}
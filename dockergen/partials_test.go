@@ -0,0 +1,134 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartials(t *testing.T) {
+	for i, tc := range []struct {
+		name      string
+		files     map[string]string
+		want      map[string]string
+		wantError string
+	}{
+		{
+			"partials are available to Dockerfile and tag templates",
+			map[string]string{
+				"dockergen.yml": `partials:
+  - partials/*.tmpl
+template-vars:
+  packages: bash git
+builds:
+  foo:
+    docker-template: Dockerfile_template.txt
+    tag: 'test/foo:{{template "version" .}}'
+    for:
+      jdk:
+        - jdk8
+`,
+				"partials/apk.tmpl":     `RUN apk add --no-cache {{.packages}}`,
+				"partials/version.tmpl": `{{.jdk}}{{template "suffix"}}{{define "suffix"}}-alpine{{end}}`,
+				"Dockerfile_template.txt": `FROM alpine
+{{template "apk" .}}
+`,
+			},
+			map[string]string{
+				"foo/jdk=jdk8/Dockerfile": "FROM alpine\nRUN apk add --no-cache bash git\n",
+			},
+			"",
+		},
+		{
+			"partials of included files are resolved relative to those files",
+			map[string]string{
+				"dockergen.yml": `include:
+  - team/dockergen.yml
+builds:
+  foo:
+    docker-template: Dockerfile_template.txt
+    tag: test/foo
+`,
+				"team/dockergen.yml": `partials:
+  - apk.tmpl
+`,
+				"team/apk.tmpl":           `RUN apk add --no-cache bash`,
+				"Dockerfile_template.txt": "FROM alpine\n{{template \"apk\" .}}\n",
+			},
+			map[string]string{
+				"foo/Dockerfile": "FROM alpine\nRUN apk add --no-cache bash\n",
+			},
+			"",
+		},
+		{
+			"partials with the same name are an error",
+			map[string]string{
+				"dockergen.yml": `partials:
+  - a/apk.tmpl
+  - b/apk.txt
+builds:
+  foo:
+    tag: test/foo
+`,
+				"a/apk.tmpl": `RUN apk add bash`,
+				"b/apk.txt":  `RUN apk add git`,
+			},
+			nil,
+			"partial apk is defined by both {{tmpDir}}/a/apk.tmpl and {{tmpDir}}/b/apk.txt",
+		},
+		{
+			"partials pattern that does not match any files is an error",
+			map[string]string{
+				"dockergen.yml": `partials:
+  - partials/*.tmpl
+builds:
+  foo:
+    tag: test/foo
+`,
+			},
+			nil,
+			"partials pattern {{tmpDir}}/partials/*.tmpl does not match any files",
+		},
+	} {
+		func() {
+			tmpDir, cleanup, err := dirs.TempDir("", "")
+			defer cleanup()
+			require.NoError(t, err, "Case %d: %s", i, tc.name)
+			for name, content := range tc.files {
+				require.NoError(t, os.MkdirAll(path.Dir(path.Join(tmpDir, name)), 0755), "Case %d: %s", i, tc.name)
+				require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, name), []byte(content), 0644), "Case %d: %s", i, tc.name)
+			}
+
+			cfg, err := dockergen.LoadConfig(path.Join(tmpDir, "dockergen.yml"))
+			require.NoError(t, err, "Case %d: %s", i, tc.name)
+			bParams, err := cfg.BuildParams()
+			require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+			outDir := path.Join(tmpDir, "out")
+			err = dockergen.Render(bParams, cfg.ToParams(), outDir, ioutil.Discard)
+			if tc.wantError != "" {
+				require.Error(t, err, fmt.Sprintf("Case %d: %s", i, tc.name))
+				assert.EqualError(t, err, strings.Replace(tc.wantError, "{{tmpDir}}", tmpDir, -1), "Case %d: %s", i, tc.name)
+				return
+			}
+			require.NoError(t, err, "Case %d: %s", i, tc.name)
+			for file, want := range tc.want {
+				got, err := ioutil.ReadFile(path.Join(outDir, file))
+				require.NoError(t, err, "Case %d: %s", i, tc.name)
+				assert.Equal(t, want, string(got), "Case %d: %s", i, tc.name)
+			}
+		}()
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Profile is a named set of overrides for a configuration, which allows a single configuration to be used for multiple
+// environments.
+type Profile struct {
+	// If non-empty, overrides the environment variable that is used to determine the unique identifier for the build.
+	BuildIDVar string `yaml:"build-id-var"`
+	// If non-empty, overrides the suffix that is appended to tags.
+	TagSuffix string `yaml:"tag-suffix"`
+	// Template variables that are added to the template variables of the configuration. Variables that are already
+	// defined are overridden.
+	TemplateVars map[string]string `yaml:"template-vars"`
+	// Overrides for the builds of the configuration. Every key must be the name of a build. Fields that are specified
+	// override the fields of the build, except for build arguments and labels, which are merged with those of the build
+	// (the values of the profile take precedence). Relative paths are resolved relative to the directory of the
+	// configuration file that defines the profile, except for contexts that use templates, which are resolved after they
+	// are rendered relative to the directory of the build.
+	Builds map[string]BuildConfig `yaml:"builds"`
+}
+
+// WithProfile returns a copy of the configuration with the profile with the provided name applied. Returns an error if
+// the configuration does not define the profile or if the profile overrides a build that is not defined.
+func (c Config) WithProfile(name string) (Config, error) {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return Config{}, errors.Errorf("profile %s is not defined in configuration. Valid profiles: %v", name, sortedProfileNames(c.Profiles))
+	}
+	if err := c.validateProfileBuilds(name, profile); err != nil {
+		return Config{}, err
+	}
+
+	applied := c
+	if profile.BuildIDVar != "" {
+		applied.BuildIDVar = profile.BuildIDVar
+	}
+	if profile.TagSuffix != "" {
+		applied.TagSuffix = profile.TagSuffix
+	}
+	applied.TemplateVars = mergeStringMaps(c.TemplateVars, profile.TemplateVars)
+	applied.Builds = nil
+	for _, item := range c.Builds {
+		build := item.Value.(BuildConfig)
+		if override, ok := profile.Builds[fmt.Sprint(item.Key)]; ok {
+			build = build.withOverrides(override)
+		}
+		applied.Builds = append(applied.Builds, yaml.MapItem{
+			Key:   item.Key,
+			Value: build,
+		})
+	}
+	return applied, nil
+}
+
+// validateProfileBuilds returns an error if the provided profile overrides a build that is not defined in the
+// configuration.
+func (c Config) validateProfileBuilds(name string, profile Profile) error {
+	defined := make(map[string]struct{})
+	for _, item := range c.Builds {
+		defined[fmt.Sprint(item.Key)] = struct{}{}
+	}
+	var undefined []string
+	for buildName := range profile.Builds {
+		if _, ok := defined[buildName]; !ok {
+			undefined = append(undefined, buildName)
+		}
+	}
+	if len(undefined) != 0 {
+		sort.Strings(undefined)
+		return errors.Errorf("profile %s overrides builds that are not defined in configuration: %v", name, undefined)
+	}
+	return nil
+}
+
+// withOverrides returns a copy of the build with the fields that are specified in the provided overrides replaced.
+func (b BuildConfig) withOverrides(overrides BuildConfig) BuildConfig {
+	merged := b
+	for _, field := range []struct {
+		merged   *string
+		override string
+	}{
+		{&merged.DockerTemplatePath, overrides.DockerTemplatePath},
+		{&merged.Tag, overrides.Tag},
+		{&merged.Context, overrides.Context},
+		{&merged.DockerignoreTemplatePath, overrides.DockerignoreTemplatePath},
+	} {
+		if field.override != "" {
+			*field.merged = field.override
+		}
+	}
+	if overrides.Tags != nil {
+		merged.Tags = overrides.Tags
+	}
+	if overrides.Aliases != nil {
+		merged.Aliases = overrides.Aliases
+	}
+	if overrides.RenderFiles != nil {
+		merged.RenderFiles = overrides.RenderFiles
+	}
+	if overrides.For != nil || overrides.Matrix != nil {
+		merged.For = overrides.For
+		merged.Matrix = overrides.Matrix
+	}
+	if overrides.Requires != nil {
+		merged.Requires = overrides.Requires
+	}
+	merged.DockerBuildOptions = overrides.DockerBuildOptions.withDefaults(b.DockerBuildOptions)
+	merged.RetryOptions = overrides.RetryOptions.withDefaults(b.RetryOptions)
+	return merged
+}
+
+// withResolvedPaths returns the profile with the relative paths of its build overrides resolved relative to the
+// provided directory. The paths are made absolute so that they are not resolved again relative to the directory of the
+// overridden builds. The Builds map of the profile is modified in place.
+func (p Profile) withResolvedPaths(dir string) Profile {
+	for name, build := range p.Builds {
+		build.DockerTemplatePath = resolveOverridePath(dir, build.DockerTemplatePath)
+		build.DockerignoreTemplatePath = resolveOverridePath(dir, build.DockerignoreTemplatePath)
+		if !strings.Contains(build.Context, "{{") {
+			// contexts that use templates can only be resolved after they are rendered
+			build.Context = resolveOverridePath(dir, build.Context)
+		}
+		p.Builds[name] = build
+	}
+	return p
+}
+
+// resolveOverridePath returns the provided path resolved relative to the provided directory as an absolute path. If the
+// absolute path cannot be determined, the resolved path is returned.
+func resolveOverridePath(dir, path string) string {
+	resolved := resolvePath(dir, path)
+	if resolved == "" || filepath.IsAbs(resolved) {
+		return resolved
+	}
+	if abs, err := filepath.Abs(resolved); err == nil {
+		return abs
+	}
+	return resolved
+}
+
+func sortedProfileNames(profiles map[string]Profile) []string {
+	var names []string
+	for k := range profiles {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
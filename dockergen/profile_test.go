@@ -0,0 +1,163 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestWithProfile(t *testing.T) {
+	const yml = `
+build-id-var: BUILD_NUM
+tag-suffix: -dev
+template-vars:
+  registry: dev.example.com
+  jdk: jdk8
+builds:
+  base:
+    docker-template: base/Dockerfile_template.txt
+    tag: "{{.registry}}/base"
+    build-args:
+      A: a
+      B: b
+  app:
+    docker-template: app/Dockerfile_template.txt
+    tag: "{{.registry}}/app"
+    requires:
+      - base
+profiles:
+  release:
+    tag-suffix: -release
+    template-vars:
+      registry: release.example.com
+    builds:
+      base:
+        aliases:
+          - "{{.registry}}/base:latest"
+        build-args:
+          B: release
+  broken:
+    builds:
+      missing:
+        tag: test/missing
+`
+
+	for i, tc := range []struct {
+		name           string
+		profile        string
+		wantError      string
+		wantVars       map[string]string
+		wantSuffix     string
+		wantBuildIDVar string
+		wantBase       dockergen.BuildParams
+	}{
+		{
+			"profile overrides settings and builds",
+			"release",
+			"",
+			map[string]string{"registry": "release.example.com", "jdk": "jdk8"},
+			"-release",
+			"BUILD_NUM",
+			dockergen.BuildParams{
+				Name:                   "base",
+				DockerfileTemplatePath: "base/Dockerfile_template.txt",
+				Tag:                    "{{.registry}}/base",
+				Aliases:                []string{"{{.registry}}/base:latest"},
+				BuildOptions: dockergen.DockerBuildOptions{
+					BuildArgs: map[string]string{"A": "a", "B": "release"},
+				},
+			},
+		},
+		{
+			"undefined profile is an error",
+			"staging",
+			"profile staging is not defined in configuration. Valid profiles: [broken release]",
+			nil,
+			"",
+			"",
+			dockergen.BuildParams{},
+		},
+		{
+			"profile that overrides undefined build is an error",
+			"broken",
+			"profile broken overrides builds that are not defined in configuration: [missing]",
+			nil,
+			"",
+			"",
+			dockergen.BuildParams{},
+		},
+	} {
+		var cfg dockergen.Config
+		require.NoError(t, yaml.Unmarshal([]byte(yml), &cfg), "Case %d: %s", i, tc.name)
+
+		applied, err := cfg.WithProfile(tc.profile)
+		if tc.wantError != "" {
+			require.Error(t, err, fmt.Sprintf("Case %d: %s", i, tc.name))
+			assert.EqualError(t, err, tc.wantError, "Case %d: %s", i, tc.name)
+			continue
+		}
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.wantVars, applied.TemplateVars, "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.wantSuffix, applied.TagSuffix, "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.wantBuildIDVar, applied.BuildIDVar, "Case %d: %s", i, tc.name)
+
+		bParams, err := applied.BuildParams()
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		require.Equal(t, 2, len(bParams), "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.wantBase, bParams[0], "Case %d: %s", i, tc.name)
+
+		// the original configuration is not modified
+		assert.Equal(t, "dev.example.com", cfg.TemplateVars["registry"], "Case %d: %s", i, tc.name)
+		origParams, err := cfg.BuildParams()
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		assert.Nil(t, origParams[0].Aliases, "Case %d: %s", i, tc.name)
+	}
+}
+
+func TestWithProfileResolvesPathsRelativeToProfileFile(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(path.Join(tmpDir, "base"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, "dockergen.yml"), []byte(`include:
+  - base/base.yml
+profiles:
+  release:
+    builds:
+      base:
+        docker-template: release_template.txt
+        context: release-context
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, "base", "base.yml"), []byte(`builds:
+  base:
+    docker-template: Dockerfile_template.txt
+    dockerignore-template: dockerignore_template.txt
+    tag: test/base
+`), 0644))
+
+	cfg, err := dockergen.LoadConfig(path.Join(tmpDir, "dockergen.yml"))
+	require.NoError(t, err)
+	applied, err := cfg.WithProfile("release")
+	require.NoError(t, err)
+	bParams, err := applied.BuildParams()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(bParams))
+
+	// the paths of the profile are resolved relative to the file that defines the profile and the other paths of the
+	// build are resolved relative to the file that defines the build
+	assert.Equal(t, path.Join(tmpDir, "release_template.txt"), bParams[0].DockerfileTemplatePath)
+	assert.Equal(t, path.Join(tmpDir, "release-context"), bParams[0].Context)
+	assert.Equal(t, path.Join(tmpDir, "base", "dockerignore_template.txt"), bParams[0].DockerignoreTemplatePath)
+}
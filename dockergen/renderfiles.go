@@ -0,0 +1,170 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// renderedFile is a file of the build context that was rendered as a template.
+type renderedFile struct {
+	// path of the file relative to the build context directory
+	relPath string
+	mode    os.FileMode
+	content string
+}
+
+// renderFiles renders the files in the provided build context directory that match the render-files patterns of the
+// build. The returned files are sorted by path. Returns an error if a pattern does not match any files or matches a
+// path that is not a regular file within the build context directory.
+func renderFiles(params runParams, contextDir string) ([]renderedFile, error) {
+	absContextDir, err := filepath.Abs(contextDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	matched := make(map[string]os.FileInfo)
+	for _, pattern := range params.build.RenderFiles {
+		matches, err := filepath.Glob(resolvePath(absContextDir, pattern))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid render-files pattern %s", pattern)
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("render-files pattern %s does not match any files in build context %s", pattern, contextDir)
+		}
+		for _, match := range matches {
+			relPath, err := filepath.Rel(absContextDir, match)
+			if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+				return nil, errors.Errorf("render-files pattern %s matches %s, which is not in build context %s", pattern, match, contextDir)
+			}
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if !info.Mode().IsRegular() {
+				return nil, errors.Errorf("render-files pattern %s matches %s, which is not a regular file", pattern, match)
+			}
+			matched[filepath.ToSlash(relPath)] = info
+		}
+	}
+
+	var relPaths []string
+	for relPath := range matched {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+
+	var files []renderedFile
+	for _, relPath := range relPaths {
+		bytes, err := ioutil.ReadFile(filepath.Join(absContextDir, filepath.FromSlash(relPath)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", relPath)
+		}
+		rendered, err := params.render(string(bytes))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to execute template for %s", relPath)
+		}
+		files = append(files, renderedFile{
+			relPath: relPath,
+			mode:    matched[relPath].Mode().Perm(),
+			content: rendered,
+		})
+	}
+	return files, nil
+}
+
+// writeRenderedFiles writes the provided files to the provided directory and returns the paths of the written files.
+func writeRenderedFiles(dir string, files []renderedFile) ([]string, error) {
+	var paths []string
+	for _, file := range files {
+		dst := filepath.Join(dir, filepath.FromSlash(file.relPath))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return nil, errors.Wrapf(err, "failed to create directory %s", filepath.Dir(dst))
+		}
+		// remove any existing file so that the mode of the rendered file is used
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "failed to remove %s", dst)
+		}
+		if err := ioutil.WriteFile(dst, []byte(file.content), file.mode); err != nil {
+			return nil, errors.Wrapf(err, "failed to write rendered file %s", dst)
+		}
+		paths = append(paths, dst)
+	}
+	return paths, nil
+}
+
+// stageContext creates a temporary directory that contains a copy of the provided build context directory in which the
+// provided files are replaced with their rendered content and returns its path. Paths excluded by the .dockerignore of
+// the build are not copied. If hasDockerignore is true, the provided rendered .dockerignore is written to the staged
+// context, replacing the .dockerignore of the context directory if it has one. The caller is responsible for removing
+// the returned directory.
+func stageContext(contextDir, dockerignoreContent string, hasDockerignore bool, files []renderedFile) (rDir string, rErr error) {
+	var ignore *dockerignore
+	var err error
+	if hasDockerignore {
+		ignore, err = parseDockerignore(strings.NewReader(dockerignoreContent))
+	} else {
+		ignore, err = readDockerignore(contextDir)
+	}
+	if err != nil {
+		return "", err
+	}
+	stageDir, err := ioutil.TempDir("", "dockergen-context-")
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create directory for staged build context")
+	}
+	defer func() {
+		if rErr != nil {
+			_ = os.RemoveAll(stageDir)
+		}
+	}()
+
+	if err := walkContext(contextDir, ignore, nil, func(relPath, absPath string, info os.FileInfo) error {
+		return copyContextEntry(filepath.Join(stageDir, filepath.FromSlash(relPath)), absPath, info)
+	}); err != nil {
+		return "", errors.Wrapf(err, "failed to stage build context %s", contextDir)
+	}
+	if hasDockerignore {
+		if err := ioutil.WriteFile(filepath.Join(stageDir, dockerignoreFileName), []byte(dockerignoreContent), 0644); err != nil {
+			return "", errors.Wrapf(err, "failed to write %s", dockerignoreFileName)
+		}
+	}
+	if _, err := writeRenderedFiles(stageDir, files); err != nil {
+		return "", err
+	}
+	return stageDir, nil
+}
+
+// copyContextEntry copies the provided entry of a build context to the provided destination. Directories are created
+// rather than copied and symbolic links are copied as links.
+func copyContextEntry(dst, src string, info os.FileInfo) error {
+	// the parent directory is not copied if it is excluded and an exception includes this path
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	switch {
+	case info.IsDir():
+		return errors.WithStack(os.MkdirAll(dst, info.Mode().Perm()))
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(os.Symlink(link, dst))
+	case info.Mode().IsRegular():
+		bytes, err := ioutil.ReadFile(src)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(ioutil.WriteFile(dst, bytes, info.Mode().Perm()))
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+const renderFilesYML = `
+builds:
+  foo:
+    docker-template: TMP_DIR/Dockerfile_template.txt
+    dockerignore-template: TMP_DIR/dockerignore.txt
+    context: TMP_DIR/src
+    tag: test/foo:{{.jdk}}
+    render-files:
+      - "*.sh"
+      - conf/app.conf
+    for:
+      jdk:
+        - jdk7
+        - jdk8
+`
+
+func writeRenderFilesInputs(t *testing.T, tmpDir string) {
+	for name, content := range map[string]string{
+		"Dockerfile_template.txt": "FROM alpine\n",
+		"dockerignore.txt":        "ignored\n",
+		"src/entrypoint.sh":       "#!/bin/sh\nexec java-{{.jdk}} \"$@\"\n",
+		"src/conf/app.conf":       "jdk={{.jdk}}\n",
+		"src/static.txt":          "{{.jdk}}",
+		"src/ignored/file.txt":    "ignored",
+	} {
+		require.NoError(t, os.MkdirAll(path.Dir(path.Join(tmpDir, name)), 0755))
+		require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, name), []byte(content), 0644))
+	}
+	require.NoError(t, os.Chmod(path.Join(tmpDir, "src", "entrypoint.sh"), 0755))
+}
+
+func TestRenderFilesBuild(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+	writeRenderFilesInputs(t, tmpDir)
+
+	var cfg dockergen.Config
+	require.NoError(t, yaml.Unmarshal([]byte(strings.Replace(renderFilesYML, "TMP_DIR", tmpDir, -1)), &cfg))
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	var contextDirs []string
+	got := make(map[string]map[string]string)
+	executors := map[string]dockergen.Executor{
+		"foo": funcExecutor(func(w io.Writer, name string, args ...string) error {
+			contextDir := args[len(args)-1]
+			contextDirs = append(contextDirs, contextDir)
+			files := make(map[string]string)
+			if err := filepath.Walk(contextDir, func(p string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(contextDir, p)
+				if err != nil {
+					return err
+				}
+				bytes, err := ioutil.ReadFile(p)
+				if err != nil {
+					return err
+				}
+				files[filepath.ToSlash(rel)] = info.Mode().Perm().String() + " " + string(bytes)
+				return nil
+			}); err != nil {
+				return err
+			}
+			got[args[2]] = files
+			return nil
+		}),
+	}
+	err = dockergen.Build(executors, bParams, cfg.ToParams(), ioutil.Discard)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]map[string]string{
+		"test/foo:jdk7-unspecified": {
+			".dockerignore": "-rw-r--r-- ignored\n",
+			"entrypoint.sh": "-rwxr-xr-x #!/bin/sh\nexec java-jdk7 \"$@\"\n",
+			"conf/app.conf": "-rw-r--r-- jdk=jdk7\n",
+			"static.txt":    "-rw-r--r-- {{.jdk}}",
+		},
+		"test/foo:jdk8-unspecified": {
+			".dockerignore": "-rw-r--r-- ignored\n",
+			"entrypoint.sh": "-rwxr-xr-x #!/bin/sh\nexec java-jdk8 \"$@\"\n",
+			"conf/app.conf": "-rw-r--r-- jdk=jdk8\n",
+			"static.txt":    "-rw-r--r-- {{.jdk}}",
+		},
+	}, got)
+
+	// the staged contexts are removed and the original context is not modified
+	require.Equal(t, 2, len(contextDirs))
+	for _, contextDir := range contextDirs {
+		assert.NotEqual(t, path.Join(tmpDir, "src"), contextDir)
+		_, err := os.Stat(contextDir)
+		assert.True(t, os.IsNotExist(err), "staged context %s was not removed", contextDir)
+	}
+	bytes, err := ioutil.ReadFile(path.Join(tmpDir, "src", "conf", "app.conf"))
+	require.NoError(t, err)
+	assert.Equal(t, "jdk={{.jdk}}\n", string(bytes))
+	_, err = os.Stat(path.Join(tmpDir, "src", ".dockerignore"))
+	assert.True(t, os.IsNotExist(err), "rendered .dockerignore was written to the context")
+}
+
+func TestRenderFilesRender(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+	writeRenderFilesInputs(t, tmpDir)
+
+	var cfg dockergen.Config
+	require.NoError(t, yaml.Unmarshal([]byte(strings.Replace(renderFilesYML, "TMP_DIR", tmpDir, -1)), &cfg))
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	outDir := path.Join(tmpDir, "out")
+	err = dockergen.Render(bParams, cfg.ToParams(), outDir, ioutil.Discard)
+	require.NoError(t, err)
+
+	var got []string
+	require.NoError(t, filepath.Walk(outDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(outDir, p)
+		if err != nil {
+			return err
+		}
+		got = append(got, filepath.ToSlash(rel))
+		return nil
+	}))
+	sort.Strings(got)
+	assert.Equal(t, []string{
+		"foo/jdk=jdk7/.dockerignore",
+		"foo/jdk=jdk7/Dockerfile",
+		"foo/jdk=jdk7/conf/app.conf",
+		"foo/jdk=jdk7/entrypoint.sh",
+		"foo/jdk=jdk8/.dockerignore",
+		"foo/jdk=jdk8/Dockerfile",
+		"foo/jdk=jdk8/conf/app.conf",
+		"foo/jdk=jdk8/entrypoint.sh",
+	}, got)
+
+	bytes, err := ioutil.ReadFile(path.Join(outDir, "foo", "jdk=jdk8", "entrypoint.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\nexec java-jdk8 \"$@\"\n", string(bytes))
+}
+
+func TestRenderFilesErrors(t *testing.T) {
+	for i, tc := range []struct {
+		name        string
+		renderFiles string
+		wantError   string
+	}{
+		{
+			"pattern that does not match any files is an error",
+			"missing/*.sh",
+			"render-files pattern missing/*.sh does not match any files in build context {{tmpDir}}/src",
+		},
+		{
+			"files outside of the build context are an error",
+			"../Dockerfile_template.txt",
+			"render-files pattern ../Dockerfile_template.txt matches {{tmpDir}}/Dockerfile_template.txt, which is not in build context {{tmpDir}}/src",
+		},
+		{
+			"directories are an error",
+			"conf",
+			"render-files pattern conf matches {{tmpDir}}/src/conf, which is not a regular file",
+		},
+	} {
+		func() {
+			tmpDir, cleanup, err := dirs.TempDir("", "")
+			defer cleanup()
+			require.NoError(t, err, "Case %d: %s", i, tc.name)
+			writeRenderFilesInputs(t, tmpDir)
+
+			yml := strings.Replace(`
+builds:
+  foo:
+    docker-template: TMP_DIR/Dockerfile_template.txt
+    context: TMP_DIR/src
+    tag: test/foo
+    render-files:
+      - `+tc.renderFiles+`
+`, "TMP_DIR", tmpDir, -1)
+			var cfg dockergen.Config
+			require.NoError(t, yaml.Unmarshal([]byte(yml), &cfg), "Case %d: %s", i, tc.name)
+			bParams, err := cfg.BuildParams()
+			require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+			err = dockergen.Render(bParams, cfg.ToParams(), path.Join(tmpDir, "out"), ioutil.Discard)
+			require.Error(t, err, "Case %d: %s", i, tc.name)
+			assert.Contains(t, err.Error(), strings.Replace(tc.wantError, "{{tmpDir}}", tmpDir, -1), "Case %d: %s", i, tc.name)
+		}()
+	}
+}
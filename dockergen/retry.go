@@ -0,0 +1,100 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultRetryBackoff is the delay before the first retry if retries are enabled and a backoff is not specified.
+const defaultRetryBackoff = time.Second
+
+// RetryOptions specify how docker commands that fail with a retryable error are retried.
+type RetryOptions struct {
+	// Number of times a failed "docker push" is retried. If 0 or not set, pushes are not retried.
+	Retries *int `yaml:"retries"`
+	// Delay before the first retry (for example, "5s"). The delay doubles after every retry. If not set, the delay is 1
+	// second.
+	RetryBackoff time.Duration `yaml:"retry-backoff"`
+	// If true, failed "docker build" commands are also retried.
+	RetryBuild *bool `yaml:"retry-build"`
+}
+
+// withDefaults returns options where the values that are not set in these options are set to the values in the
+// provided defaults.
+func (o RetryOptions) withDefaults(defaults RetryOptions) RetryOptions {
+	merged := o
+	if merged.Retries == nil {
+		merged.Retries = defaults.Retries
+	}
+	if merged.RetryBackoff == 0 {
+		merged.RetryBackoff = defaults.RetryBackoff
+	}
+	if merged.RetryBuild == nil {
+		merged.RetryBuild = defaults.RetryBuild
+	}
+	return merged
+}
+
+func (o RetryOptions) retries() int {
+	if o.Retries == nil || *o.Retries < 0 {
+		return 0
+	}
+	return *o.Retries
+}
+
+func (o RetryOptions) backoff() time.Duration {
+	if o.RetryBackoff <= 0 {
+		return defaultRetryBackoff
+	}
+	return o.RetryBackoff
+}
+
+func (o RetryOptions) retryBuild() bool {
+	return o.RetryBuild != nil && *o.RetryBuild
+}
+
+// retryableErrorRegexp matches the output of docker commands that failed because of transient network or registry
+// errors.
+var retryableErrorRegexp = regexp.MustCompile(`(?i)(connection reset|connection refused|broken pipe|i/o timeout|` +
+	`timeout exceeded|timed out|TLS handshake timeout|unexpected EOF|no such host|temporary failure|` +
+	`toomanyrequests|too many requests|service unavailable|bad gateway|gateway timeout|internal server error|` +
+	`received unexpected HTTP status: 5[0-9][0-9]|returned 5[0-9][0-9])`)
+
+// isRetryable returns true if the provided error and output of a failed docker command indicate that the failure was
+// transient.
+func isRetryable(err error, output []byte) bool {
+	return retryableErrorRegexp.Match(output) || retryableErrorRegexp.MatchString(err.Error())
+}
+
+// runDockerWithRetries runs the docker command with the provided arguments. If the command fails with a retryable error,
+// it is retried up to the provided number of times with exponential backoff starting at the provided delay.
+func (p runParams) runDockerWithRetries(retries int, backoff time.Duration, args ...string) error {
+	for attempt := 0; ; attempt++ {
+		output := &bytes.Buffer{}
+		runParams := p
+		runParams.stdout = io.MultiWriter(p.stdout, output)
+		err := runParams.runDocker(args...)
+		if err == nil || attempt >= retries || p.state.ctx.Err() != nil || !isRetryable(err, output.Bytes()) {
+			return err
+		}
+
+		delay := backoff << uint(attempt)
+		_, _ = fmt.Fprintf(p.stdout, "Retrying docker %v in %v (retry %d of %d) after error: %v\n", args, delay, attempt+1, retries, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-p.state.ctx.Done():
+			timer.Stop()
+			return errors.Wrapf(p.state.ctx.Err(), "run was stopped while waiting to retry")
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRetry(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, "Dockerfile_template.txt"), []byte("FROM scratch\n"), 0644))
+
+	zero := 0
+	for i, tc := range []struct {
+		name         string
+		yml          string
+		action       func(map[string]dockergen.Executor, []dockergen.BuildParams, dockergen.Params, io.Writer) error
+		failures     int
+		failOutput   string
+		retry        dockergen.RetryOptions
+		wantAttempts int
+		wantError    string
+	}{
+		{
+			"push is retried after retryable error",
+			`
+retries: 2
+retry-backoff: 1ms
+builds:
+  foo:
+    tag: test/foo
+`,
+			dockergen.Push,
+			2,
+			"Put https://registry/v2/: net/http: TLS handshake timeout",
+			dockergen.RetryOptions{},
+			3,
+			"",
+		},
+		{
+			"push fails after retries are exhausted",
+			`
+retries: 1
+retry-backoff: 1ms
+builds:
+  foo:
+    tag: test/foo
+`,
+			dockergen.Push,
+			2,
+			"received unexpected HTTP status: 503 Service Unavailable",
+			dockergen.RetryOptions{},
+			2,
+			"failed to execute command [push test/foo-unspecified]: attempt 2 failed",
+		},
+		{
+			"push is not retried after non-retryable error",
+			`
+retries: 2
+retry-backoff: 1ms
+builds:
+  foo:
+    tag: test/foo
+`,
+			dockergen.Push,
+			1,
+			"denied: requested access to the resource is denied",
+			dockergen.RetryOptions{},
+			1,
+			"failed to execute command [push test/foo-unspecified]: attempt 1 failed",
+		},
+		{
+			"options for build take precedence over configuration",
+			`
+retries: 2
+retry-backoff: 1ms
+builds:
+  foo:
+    tag: test/foo
+    retries: 0
+`,
+			dockergen.Push,
+			1,
+			"connection reset by peer",
+			dockergen.RetryOptions{},
+			1,
+			"failed to execute command [push test/foo-unspecified]: attempt 1 failed",
+		},
+		{
+			"params take precedence over options for build",
+			`
+retries: 2
+retry-backoff: 1ms
+builds:
+  foo:
+    tag: test/foo
+`,
+			dockergen.Push,
+			1,
+			"connection reset by peer",
+			dockergen.RetryOptions{Retries: &zero},
+			1,
+			"failed to execute command [push test/foo-unspecified]: attempt 1 failed",
+		},
+		{
+			"build is not retried by default",
+			`
+retries: 2
+retry-backoff: 1ms
+builds:
+  foo:
+    docker-template: Dockerfile_template.txt
+    tag: test/foo
+`,
+			dockergen.Build,
+			1,
+			"connection reset by peer",
+			dockergen.RetryOptions{},
+			1,
+			"attempt 1 failed",
+		},
+		{
+			"build is retried if retry-build is true",
+			`
+retries: 2
+retry-backoff: 1ms
+retry-build: true
+builds:
+  foo:
+    docker-template: Dockerfile_template.txt
+    tag: test/foo
+`,
+			dockergen.Build,
+			1,
+			"connection reset by peer",
+			dockergen.RetryOptions{},
+			2,
+			"",
+		},
+	} {
+		var cfg dockergen.Config
+		err := yaml.Unmarshal([]byte(tc.yml), &cfg)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		cfg.Dir = tmpDir
+		bParams, err := cfg.BuildParams()
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		attempts := 0
+		executor := funcExecutor(func(w io.Writer, name string, args ...string) error {
+			attempts++
+			if attempts <= tc.failures {
+				_, _ = fmt.Fprintln(w, tc.failOutput)
+				return fmt.Errorf("attempt %d failed", attempts)
+			}
+			return nil
+		})
+		params := cfg.ToParams()
+		params.Retry = tc.retry
+		output := &bytes.Buffer{}
+		err = tc.action(map[string]dockergen.Executor{"foo": executor}, bParams, params, output)
+		if tc.wantError != "" {
+			require.Error(t, err, fmt.Sprintf("Case %d: %s", i, tc.name))
+			assert.Contains(t, err.Error(), tc.wantError, "Case %d: %s", i, tc.name)
+		} else {
+			require.NoError(t, err, "Case %d: %s", i, tc.name)
+		}
+		assert.Equal(t, tc.wantAttempts, attempts, "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.wantAttempts-1, strings.Count(output.String(), "Retrying docker"), "Case %d: %s", i, tc.name)
+	}
+}
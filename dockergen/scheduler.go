@@ -0,0 +1,274 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// unitStatus is the status of a unit at the end of a run.
+type unitStatus int
+
+const (
+	unitNotRun unitStatus = iota
+	unitSucceeded
+	unitFailed
+	unitSkipped
+)
+
+func (s unitStatus) String() string {
+	switch s {
+	case unitSucceeded:
+		return "succeeded"
+	case unitFailed:
+		return "failed"
+	case unitSkipped:
+		return "skipped"
+	default:
+		return "not run"
+	}
+}
+
+// unitOutcome is the outcome of running a unit.
+type unitOutcome struct {
+	status unitStatus
+	// error returned by the action. Only set if the status is unitFailed.
+	err error
+}
+
+// runUnits runs the provided action for all of the provided units. If parallelism is less than 2, the units are run
+// sequentially in the order in which they were provided. Otherwise, up to parallelism units are run concurrently, where
+// a unit is started as soon as all of the units it depends on have completed. The provided dependencies are the
+// indexes of the units that each unit depends on (see unitDependencies). When units are run concurrently, the output of
+// each unit is buffered and written to stdout when the unit completes so that the output of different units is not
+// interleaved. No new units are started after the context of the run is done.
+//
+// By default, no new units are started after a unit fails. If the run should keep going, the units that do not depend
+// on a failed unit (directly or transitively) are still run, the units that do are skipped and a summary of the outcome
+// of every unit is written to stdout at the end of the run.
+func runUnits(action runActionFunc, units []buildUnit, deps [][]int, state *runState, parallelism int, stdout io.Writer) error {
+	outcomes := make([]unitOutcome, len(units))
+	var err error
+	if parallelism < 2 {
+		err = runUnitsSequentially(action, units, deps, outcomes, state, stdout)
+	} else {
+		err = runUnitsConcurrently(action, units, deps, outcomes, state, parallelism, stdout)
+	}
+	if !state.keepGoing {
+		return err
+	}
+
+	writeSummary(stdout, units, outcomes)
+	if err != nil {
+		return err
+	}
+	var failed, skipped int
+	for _, outcome := range outcomes {
+		switch outcome.status {
+		case unitFailed:
+			failed++
+		case unitSkipped:
+			skipped++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d build iterations failed and %d were skipped", failed, len(units), skipped)
+	}
+	return nil
+}
+
+func runUnitsSequentially(action runActionFunc, units []buildUnit, deps [][]int, outcomes []unitOutcome, state *runState, stdout io.Writer) error {
+	for i, unit := range units {
+		if err := state.ctx.Err(); err != nil {
+			return errors.Wrapf(err, "run was stopped before building %s", unit.build.Name)
+		}
+		if dependsOnUnsuccessful(deps[i], outcomes) {
+			outcomes[i].status = unitSkipped
+			state.emitSkipped(unit)
+			continue
+		}
+		start := state.emitStarted(unit)
+		err := action(unit.runParams(state, stdout))
+		state.emitFinished(unit, start, err)
+		if err != nil {
+			outcomes[i] = unitOutcome{status: unitFailed, err: err}
+			if !state.keepGoing {
+				return errors.Wrapf(err, "failed to build %s", unit.build.Name)
+			}
+			continue
+		}
+		outcomes[i].status = unitSucceeded
+	}
+	return nil
+}
+
+// dependsOnUnsuccessful returns true if any of the provided dependencies failed or was skipped.
+func dependsOnUnsuccessful(deps []int, outcomes []unitOutcome) bool {
+	for _, dep := range deps {
+		if outcomes[dep].status == unitFailed || outcomes[dep].status == unitSkipped {
+			return true
+		}
+	}
+	return false
+}
+
+func runUnitsConcurrently(action runActionFunc, units []buildUnit, deps [][]int, outcomes []unitOutcome, state *runState, parallelism int, stdout io.Writer) error {
+	type unitResult struct {
+		idx    int
+		output *bytes.Buffer
+		err    error
+	}
+
+	pending := make([]int, len(units))
+	dependents := make([][]int, len(units))
+	var ready []int
+	for i, currDeps := range deps {
+		pending[i] = len(currDeps)
+		for _, dep := range currDeps {
+			dependents[dep] = append(dependents[dep], i)
+		}
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	// skipDependents marks all of the units that depend on the provided unit (directly or transitively) as skipped.
+	// These units are never started because they have a dependency that did not succeed.
+	var skipDependents func(idx int)
+	skipDependents = func(idx int) {
+		for _, dependent := range dependents[idx] {
+			if outcomes[dependent].status == unitSkipped {
+				continue
+			}
+			outcomes[dependent].status = unitSkipped
+			state.emitSkipped(units[dependent])
+			skipDependents(dependent)
+		}
+	}
+
+	results := make(chan unitResult)
+	startTimes := make([]time.Time, len(units))
+	running := 0
+	var firstErr error
+	for {
+		// start as many ready units as possible. Units are started in their original order so that the execution order
+		// is as close to the sequential order as possible. No new units are started after a failure.
+		if err := state.ctx.Err(); err != nil && firstErr == nil && len(ready) > 0 {
+			firstErr = errors.Wrapf(err, "run was stopped before building %s", units[ready[0]].build.Name)
+		}
+		for firstErr == nil && running < parallelism && len(ready) > 0 {
+			idx := ready[0]
+			ready = ready[1:]
+			running++
+			startTimes[idx] = state.emitStarted(units[idx])
+			go func(idx int) {
+				output := &bytes.Buffer{}
+				err := action(units[idx].runParams(state, output))
+				results <- unitResult{
+					idx:    idx,
+					output: output,
+					err:    err,
+				}
+			}(idx)
+		}
+		if running == 0 {
+			break
+		}
+
+		result := <-results
+		running--
+		_, _ = stdout.Write(result.output.Bytes())
+		state.emitFinished(units[result.idx], startTimes[result.idx], result.err)
+		if result.err != nil {
+			outcomes[result.idx] = unitOutcome{status: unitFailed, err: result.err}
+			if state.keepGoing {
+				skipDependents(result.idx)
+			} else if firstErr == nil {
+				firstErr = errors.Wrapf(result.err, "failed to build %s", units[result.idx].build.Name)
+			}
+			continue
+		}
+		outcomes[result.idx].status = unitSucceeded
+		for _, dependent := range dependents[result.idx] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+		sort.Ints(ready)
+	}
+	return firstErr
+}
+
+// writeSummary writes a table of the outcome of every unit followed by the errors of the units that failed.
+func writeSummary(w io.Writer, units []buildUnit, outcomes []unitOutcome) {
+	_, _ = fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "BUILD\tVARS\tTAG\tSTATUS")
+	for i, unit := range units {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", unit.build.Name, formatVars(unit.iterVars), unit.tag, outcomes[i].status)
+	}
+	_ = tw.Flush()
+	for i, unit := range units {
+		if outcomes[i].status != unitFailed {
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "\n%s %s (%s) failed: %v\n", unit.build.Name, formatVars(unit.iterVars), unit.tag, outcomes[i].err)
+	}
+}
+
+// unitDependencies returns the indexes of the units that each unit depends on. A unit depends on the units of its
+// required builds that are in the same iteration of the outer "for" variables and on the units whose tags are
+// referenced by its templates using the "Tag" or "TagFor" template functions. Only units that precede the unit are
+// considered because these are the units that are guaranteed to have completed before the unit is run when units are
+// run sequentially. If the templates of a unit cannot be rendered, the unit fails when it is run, so only the units of
+// its required builds are considered.
+func unitDependencies(units []buildUnit, tags *tagStore) [][]int {
+	unitsForBuild := make(map[string][]int)
+	// positions maps the index of a unit in the plan, which is the index returned by referencedUnits, to its index in
+	// the provided units
+	positions := make(map[int]int, len(units))
+	for i, unit := range units {
+		unitsForBuild[unit.build.Name] = append(unitsForBuild[unit.build.Name], i)
+		positions[unit.planIdx] = i
+	}
+
+	deps := make([][]int, len(units))
+	for i, unit := range units {
+		seen := make(map[int]struct{})
+		addDep := func(dep int) {
+			if _, ok := seen[dep]; ok || dep >= i {
+				return
+			}
+			seen[dep] = struct{}{}
+			deps[i] = append(deps[i], dep)
+		}
+		for _, currReq := range unit.build.Requires {
+			for _, reqIdx := range unitsForBuild[currReq] {
+				if units[reqIdx].outerIdx == unit.outerIdx {
+					addDep(reqIdx)
+				}
+			}
+		}
+		referenced, err := referencedUnits(unit, tags)
+		if err != nil {
+			continue
+		}
+		for _, ref := range referenced {
+			if pos, ok := positions[ref]; ok {
+				addDep(pos)
+			}
+		}
+		sort.Ints(deps[i])
+	}
+	return deps
+}
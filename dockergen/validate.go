@@ -0,0 +1,392 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ValidationError is a problem with a configuration file.
+type ValidationError struct {
+	// Path of the configuration file in which the problem occurs if it is not the file that was validated or loaded (for
+	// example, a file that it includes). Empty otherwise.
+	File string
+	// Line of the configuration file on which the problem occurs (starting at 1). 0 if the line is not known.
+	Line int
+	// Column of the line at which the problem occurs (starting at 1). 0 if the column is not known.
+	Column int
+	// Description of the problem.
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.format(e.File)
+}
+
+// format returns the problem prefixed with its position in the provided file in the form "file:line:column: ". Parts of
+// the position that are not known are omitted.
+func (e ValidationError) format(path string) string {
+	var pos []string
+	if path != "" {
+		pos = append(pos, path)
+	}
+	if e.Line > 0 {
+		pos = append(pos, strconv.Itoa(e.Line))
+		if e.Column > 0 {
+			pos = append(pos, strconv.Itoa(e.Column))
+		}
+	}
+	if len(pos) == 0 {
+		return e.Message
+	}
+	return strings.Join(pos, ":") + ": " + e.Message
+}
+
+// dockerReferenceRegexp matches valid Docker image references ("[domain/]name[:tag][@digest]").
+var dockerReferenceRegexp = func() *regexp.Regexp {
+	const (
+		alphaNumeric    = `[a-z0-9]+`
+		separator       = `(?:[._]|__|[-]*)`
+		nameComponent   = alphaNumeric + `(?:` + separator + alphaNumeric + `)*`
+		domainComponent = `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+		domain          = domainComponent + `(?:\.` + domainComponent + `)*(?::[0-9]+)?`
+		name            = `(?:` + domain + `/)?` + nameComponent + `(?:/` + nameComponent + `)*`
+		tag             = `[\w][\w.-]{0,127}`
+		digest          = `[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}`
+	)
+	return regexp.MustCompile(`^` + name + `(?::` + tag + `)?(?:@` + digest + `)?$`)
+}()
+
+// maxDockerNameLength is the maximum length of the name portion of a Docker image reference.
+const maxDockerNameLength = 255
+
+// validateDockerReference returns an error if the provided tag is not a valid Docker image reference.
+func validateDockerReference(tag string) error {
+	if !dockerReferenceRegexp.MatchString(tag) {
+		return errors.Errorf("%q is not a valid Docker image reference", tag)
+	}
+	name := strings.SplitN(tag, "@", 2)[0]
+	if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		name = name[:idx]
+	}
+	if len(name) > maxDockerNameLength {
+		return errors.Errorf("%q is not a valid Docker image reference: name is longer than %d characters", tag, maxDockerNameLength)
+	}
+	return nil
+}
+
+// ValidateConfig checks the configuration file at the provided path and the files that it includes without running any
+// docker commands. It checks that the files do not contain unknown keys, that the configuration is valid, that all of
+// the templates exist, parse and only reference variables that are defined, that the "Tag" and "TagFor" template
+// functions are only used with builds that are declared in "requires" and with indexes that are in range and that all
+// of the rendered tags are valid Docker image references. Returns all of the problems that were found sorted by file and
+// position. Returns an error only if the file cannot be read.
+func ValidateConfig(path string) ([]ValidationError, error) {
+	return ValidateConfigWithOverrides(path, "", VarOverrides{})
+}
+
+// ValidateConfigWithOverrides is like ValidateConfig, but validates the configuration with the profile with the provided
+// name (if it is non-empty) and the provided variable overrides applied. Problems with the profile or the overrides are
+// reported as problems of the configuration.
+func ValidateConfigWithOverrides(path, profile string, overrides VarOverrides) ([]ValidationError, error) {
+	if _, err := ioutil.ReadFile(path); err != nil {
+		return nil, errors.Wrapf(err, "failed to read config file")
+	}
+	v := &validator{
+		profile:    profile,
+		overrides:  overrides,
+		buildFiles: make(map[string]*configFile),
+		seen:       make(map[ValidationError]struct{}),
+	}
+	v.validate(path)
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		if v.errs[i].File != v.errs[j].File {
+			return v.errs[i].File < v.errs[j].File
+		}
+		if v.errs[i].Line != v.errs[j].Line {
+			return v.errs[i].Line < v.errs[j].Line
+		}
+		return v.errs[i].Column < v.errs[j].Column
+	})
+	return v.errs, nil
+}
+
+// validator collects the problems found in a configuration file and the files that it includes.
+type validator struct {
+	// the profile and variable overrides that are applied to the configuration before its templates are validated
+	profile   string
+	overrides VarOverrides
+	// the configuration file that is validated
+	root *configFile
+	// the file that defines each build
+	buildFiles map[string]*configFile
+	errs       []ValidationError
+	seen       map[ValidationError]struct{}
+}
+
+// addf records a problem for the key with the provided path. Keys of builds are located in the file that defines the
+// build and all other keys are located in the root file.
+func (v *validator) addf(keyPath string, format string, args ...interface{}) {
+	file := v.root
+	var longestName string
+	for name, buildFile := range v.buildFiles {
+		prefix := "builds." + name
+		if len(name) < len(longestName) || !strings.HasPrefix(keyPath, prefix) {
+			continue
+		}
+		if rest := keyPath[len(prefix):]; rest == "" || rest[0] == '.' || rest[0] == '[' {
+			file = buildFile
+			longestName = name
+		}
+	}
+	v.addfIn(file, keyPath, format, args...)
+}
+
+// addfIn records a problem for the key with the provided path in the provided file.
+func (v *validator) addfIn(file *configFile, keyPath string, format string, args ...interface{}) {
+	pos := file.keyPositions().pos(keyPath)
+	verr := ValidationError{
+		Line:    pos.line,
+		Column:  pos.column,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if file != v.root {
+		verr.File = file.path
+	}
+	v.add(verr)
+}
+
+// add records the provided problem. Duplicate problems, which typically occur when a template fails in the same way for
+// every iteration of a build, are only recorded once.
+func (v *validator) add(verr ValidationError) {
+	if _, ok := v.seen[verr]; ok {
+		return
+	}
+	v.seen[verr] = struct{}{}
+	v.errs = append(v.errs, verr)
+}
+
+func (v *validator) validate(path string) {
+	files, err := loadConfigFiles(path, false)
+	if err != nil {
+		if cfgErr, ok := err.(*ConfigError); ok {
+			for _, verr := range cfgErr.Errors {
+				if cfgErr.Path != path {
+					verr.File = cfgErr.Path
+				}
+				v.add(verr)
+			}
+			return
+		}
+		v.add(ValidationError{Message: err.Error()})
+		return
+	}
+	v.root = files[0]
+	for _, file := range files {
+		for _, verr := range file.unknownKeys {
+			if file != v.root {
+				verr.File = file.path
+			}
+			v.add(verr)
+		}
+		for _, item := range file.cfg.Builds {
+			if name := fmt.Sprint(item.Key); v.buildFiles[name] == nil {
+				v.buildFiles[name] = file
+			}
+		}
+	}
+	cfg, conflicts := mergeConfigFiles(files)
+	for _, verr := range conflicts {
+		v.add(verr)
+	}
+	for _, file := range files {
+		for _, profileName := range sortedProfileNames(file.cfg.Profiles) {
+			for _, buildName := range sortedBuildConfigNames(file.cfg.Profiles[profileName].Builds) {
+				if v.buildFiles[buildName] == nil {
+					v.addfIn(file, "profiles."+profileName+".builds."+buildName, "profile %s overrides build %s, which is not defined", profileName, buildName)
+				}
+			}
+		}
+	}
+	// unknown keys and conflicts between files do not prevent the rest of the configuration from being validated
+	numNonBlockingErrs := len(v.errs)
+
+	if v.profile != "" {
+		profileCfg, err := cfg.WithProfile(v.profile)
+		if err != nil {
+			v.addf("profiles", "%v", err)
+			return
+		}
+		cfg = profileCfg
+	}
+	overriddenCfg, err := cfg.WithVarOverrides(v.overrides)
+	if err != nil {
+		v.add(ValidationError{Message: err.Error()})
+		return
+	}
+	cfg = overriddenCfg
+
+	params := cfg.ToParams()
+	if err := params.Validate(); err != nil {
+		keyPath := "for"
+		if params.Matrix != nil {
+			keyPath = "matrix"
+		}
+		v.addf(keyPath, "%v", err)
+	}
+	partials, err := loadPartials(params.Partials)
+	if err != nil {
+		v.addf("partials", "%v", err)
+	}
+	for k, tmpl := range cfg.TemplateVars {
+		if _, err := executeStrictGoTemplate(tmpl, cfg.baseDir(), defaultBuildID, partials, nil, nil, -1, -1); err != nil {
+			v.addf("template-vars."+k, "template for variable %s: %v", k, err)
+		}
+	}
+
+	names := make(map[string]struct{})
+	for _, item := range cfg.Builds {
+		names[fmt.Sprint(item.Key)] = struct{}{}
+	}
+	for _, item := range cfg.Builds {
+		name := fmt.Sprint(item.Key)
+		build := item.Value.(BuildConfig)
+		if err := validateLoop(build.For, build.Matrix); err != nil {
+			v.addf("builds."+name+".matrix", "build %s: %v", name, err)
+		}
+		if err := validateForLengths(build.For, "'for'"); err != nil {
+			v.addf("builds."+name+".for", "build %s: %v", name, err)
+		}
+		for i, req := range build.Requires {
+			if _, ok := names[req]; !ok {
+				v.addf(fmt.Sprintf("builds.%s.requires[%d]", name, i), "build %s requires build %s, which is not defined", name, req)
+			}
+		}
+		for _, tmplPath := range []struct {
+			key  string
+			path string
+		}{
+			{"docker-template", build.DockerTemplatePath},
+			{"dockerignore-template", build.DockerignoreTemplatePath},
+		} {
+			if tmplPath.path == "" {
+				continue
+			}
+			if _, err := ioutil.ReadFile(resolvePath(cfg.buildDir(build), tmplPath.path)); err != nil {
+				v.addf("builds."+name+"."+tmplPath.key, "build %s: failed to read %s: %v", name, tmplPath.key, err)
+			}
+		}
+	}
+	if len(v.errs) != numNonBlockingErrs {
+		// the templates cannot be rendered if the configuration is invalid
+		return
+	}
+
+	builds, err := cfg.BuildParams()
+	if err != nil {
+		v.addf("builds", "%v", err)
+		return
+	}
+	v.validateTemplates(TopologicalSort(builds), params)
+}
+
+// validateTemplates renders all of the templates of the provided builds for every iteration and records the problems
+// that occur.
+func (v *validator) validateTemplates(builds []BuildParams, params Params) {
+	units, tags, err := planRun(builds, params)
+	if err != nil {
+		if planErr, ok := err.(*planError); ok {
+			v.addf("builds."+planErr.build, "build %s: %v", planErr.build, errors.Cause(err))
+			return
+		}
+		v.addf("builds", "%v", errors.Cause(err))
+		return
+	}
+
+	tagSuffix := params.TagSuffix
+	for _, unit := range units {
+		keyPrefix := "builds." + unit.build.Name
+		referenced := make(map[int]struct{})
+		state := &runState{
+			tags: tags.tracking(func(unitIdx int) {
+				referenced[unitIdx] = struct{}{}
+			}),
+			strictTemplates: true,
+		}
+		p := unit.runParams(state, ioutil.Discard)
+		renderf := func(keyPath, field, tmpl string) bool {
+			if _, err := p.render(tmpl); err != nil {
+				v.addf(keyPath, "build %s: template for %s: %v", unit.build.Name, field, errors.Cause(err))
+				return false
+			}
+			return true
+		}
+
+		// rendered tags are only validated if all of the templates for them render successfully
+		validTagTmpls := true
+		if tagSuffix != "" {
+			validTagTmpls = renderf("tag-suffix", "tag-suffix", tagSuffix) && validTagTmpls
+		}
+		if unit.build.Tag != "" {
+			validTagTmpls = renderf(keyPrefix+".tag", "tag", unit.build.Tag) && validTagTmpls
+		}
+		for i, tmpl := range unit.build.Tags {
+			validTagTmpls = renderf(fmt.Sprintf("%s.tags[%d]", keyPrefix, i), "tags", tmpl) && validTagTmpls
+		}
+		for i, tmpl := range unit.build.Aliases {
+			validTagTmpls = renderf(fmt.Sprintf("%s.aliases[%d]", keyPrefix, i), "aliases", tmpl) && validTagTmpls
+		}
+		if unit.build.Context != "" {
+			renderf(keyPrefix+".context", "context", unit.build.Context)
+		}
+		if _, err := unit.build.BuildOptions.render(p.render); err != nil {
+			v.addf(keyPrefix, "build %s: %v", unit.build.Name, err)
+		}
+		if unit.build.DockerfileTemplatePath != "" {
+			if _, err := renderDockerfile(p); err != nil {
+				v.addf(keyPrefix+".docker-template", "build %s: %s: %v", unit.build.Name, unit.build.DockerfileTemplatePath, errors.Cause(err))
+			}
+		}
+		if _, _, err := renderDockerignore(p); err != nil {
+			v.addf(keyPrefix+".dockerignore-template", "build %s: %s: %v", unit.build.Name, unit.build.DockerignoreTemplatePath, errors.Cause(err))
+		}
+		if len(unit.build.RenderFiles) > 0 {
+			// problems with the context are recorded when its template is validated
+			if contextDir, err := renderContextDir(p); err == nil {
+				if _, err := renderFiles(p, contextDir); err != nil {
+					v.addf(keyPrefix+".render-files", "build %s: %v", unit.build.Name, err)
+				}
+			}
+		}
+
+		var referencedNames []string
+		for idx := range referenced {
+			if name := units[idx].build.Name; name != unit.build.Name && !containsString(referencedNames, name) {
+				referencedNames = append(referencedNames, name)
+			}
+		}
+		sort.Strings(referencedNames)
+		for _, name := range referencedNames {
+			if !containsString(unit.build.Requires, name) {
+				v.addf(keyPrefix+".requires", "build %s uses the tag of build %s, but does not declare it in requires", unit.build.Name, name)
+			}
+		}
+
+		if validTagTmpls {
+			for _, tag := range p.allTags() {
+				if err := validateDockerReference(tag); err != nil {
+					v.addf(keyPrefix+".tag", "build %s: %v", unit.build.Name, err)
+				}
+			}
+		}
+	}
+}
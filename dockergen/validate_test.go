@@ -0,0 +1,238 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/nmiyake/pkg/dirs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+
+	for name, content := range map[string]string{
+		"base_template.txt":         "FROM scratch\n",
+		"app_template.txt":          "FROM {{Tag \"base\" 0 0}}\n",
+		"undeclared_template.txt":   "FROM {{Tag \"base\" 0 0}}\n",
+		"out_of_range_template.txt": "FROM {{Tag \"base\" 0 5}}\n",
+		"missing_var_template.txt":  "FROM scratch\nENV JDK={{.jdk}}\n",
+		"parse_error_template.txt":  "FROM scratch\n{{end}}\n",
+	} {
+		require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, name), []byte(content), 0644))
+	}
+
+	for i, tc := range []struct {
+		name string
+		yml  string
+		want []dockergen.ValidationError
+	}{
+		{
+			"valid configuration",
+			`
+builds:
+  base:
+    docker-template: base_template.txt
+    tag: test/base:{{.jdk}}
+    for:
+      jdk:
+        - jdk7
+        - jdk8
+  app:
+    docker-template: app_template.txt
+    tag: test/app
+    requires:
+      - base
+`,
+			nil,
+		},
+		{
+			"unknown keys and problems with builds are all reported",
+			`
+tag-sufix: -t1
+builds:
+  base:
+    docker-templte: base_template.txt
+    tag: test/base
+  app:
+    docker-template: missing_template.txt
+    tag: test/app
+    for:
+      a:
+        - "1"
+        - "2"
+      b:
+        - "1"
+    requires:
+      - bse
+`,
+			[]dockergen.ValidationError{
+				{Line: 1, Column: 1, Message: `unknown key "tag-sufix"`},
+				{Line: 4, Column: 5, Message: `unknown key "builds.base.docker-templte"`},
+				{Line: 7, Column: 5, Message: "build app: failed to read docker-template: open " + path.Join(tmpDir, "missing_template.txt") + ": no such file or directory"},
+				{Line: 9, Column: 5, Message: "build app: Length of all 'for' variable arrays must be the same:\n\ta: 2\n\tb: 1"},
+				{Line: 16, Column: 9, Message: "build app requires build bse, which is not defined"},
+			},
+		},
+		{
+			"problems with templates are all reported",
+			`
+builds:
+  base:
+    docker-template: base_template.txt
+    tag: test/base
+  undeclared:
+    docker-template: undeclared_template.txt
+    tag: test/undeclared
+  out-of-range:
+    docker-template: out_of_range_template.txt
+    tag: test/out-of-range
+    requires:
+      - base
+  missing-var:
+    docker-template: missing_var_template.txt
+    tag: test/missing-var
+    aliases:
+      - test/missing-var:{{.version}}
+  parse-error:
+    docker-template: parse_error_template.txt
+    tag: Test/Parse-Error
+`,
+			[]dockergen.ValidationError{
+				{Line: 5, Column: 3, Message: "build undeclared uses the tag of build base, but does not declare it in requires"},
+				{Line: 9, Column: 5, Message: `build out-of-range: ` + path.Join(tmpDir, "out_of_range_template.txt") + `: template: env:1:7: executing "env" at <Tag "base" 0 5>: error calling Tag: inner index out of bounds: 5 > 1`},
+				{Line: 14, Column: 5, Message: `build missing-var: ` + path.Join(tmpDir, "missing_var_template.txt") + `: template: env:2:10: executing "env" at <.jdk>: map has no entry for key "jdk"`},
+				{Line: 17, Column: 9, Message: `build missing-var: template for aliases: template: env:1:19: executing "env" at <.version>: map has no entry for key "version"`},
+				{Line: 19, Column: 5, Message: `build parse-error: ` + path.Join(tmpDir, "parse_error_template.txt") + `: template: env:2: unexpected {{end}}`},
+				{Line: 20, Column: 5, Message: `build parse-error: "Test/Parse-Error-unspecified" is not a valid Docker image reference`},
+			},
+		},
+		{
+			"duplicate tags are reported for the build that reuses the tag",
+			`
+builds:
+  base:
+    tag: test/base
+  app:
+    tag: test/app
+    aliases:
+      - test/base-unspecified
+`,
+			[]dockergen.ValidationError{
+				{Line: 4, Column: 3, Message: "build app: tag test/base-unspecified is used by both base and app"},
+			},
+		},
+	} {
+		cfgPath := path.Join(tmpDir, "dockergen.yml")
+		require.NoError(t, ioutil.WriteFile(cfgPath, []byte(tc.yml[1:]), 0644), "Case %d: %s", i, tc.name)
+
+		got, err := dockergen.ValidateConfig(cfgPath)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.want, got, "Case %d: %s", i, tc.name)
+	}
+}
+
+func TestValidateConfigWithOverrides(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+	cfgPath := path.Join(tmpDir, "dockergen.yml")
+	require.NoError(t, ioutil.WriteFile(cfgPath, []byte(`builds:
+  base:
+    tag: test/base:{{.jdk}}
+    for:
+      jdk:
+        - jdk7
+        - jdk8
+  app:
+    tag: test/app:{{.version}}
+profiles:
+  release:
+    template-vars:
+      version: "1.0"
+`), 0644))
+
+	for i, tc := range []struct {
+		name      string
+		profile   string
+		overrides dockergen.VarOverrides
+		want      []dockergen.ValidationError
+	}{
+		{
+			"variable is missing without profile",
+			"",
+			dockergen.VarOverrides{},
+			[]dockergen.ValidationError{
+				{Line: 9, Column: 5, Message: `build app: template for tag: template: env:1:11: executing "env" at <.version>: map has no entry for key "version"`},
+			},
+		},
+		{
+			"variable is defined by profile",
+			"release",
+			dockergen.VarOverrides{},
+			nil,
+		},
+		{
+			"variable is defined by override",
+			"",
+			dockergen.VarOverrides{Set: map[string]string{"version": "2.0"}},
+			nil,
+		},
+		{
+			"unknown profile is reported",
+			"unknown",
+			dockergen.VarOverrides{},
+			[]dockergen.ValidationError{
+				{Line: 10, Column: 1, Message: "profile unknown is not defined in configuration. Valid profiles: [release]"},
+			},
+		},
+		{
+			"invalid 'for' override is reported",
+			"release",
+			dockergen.VarOverrides{For: map[string][]string{"jdk": {"jdk11"}}},
+			[]dockergen.ValidationError{
+				{Message: "invalid 'for' override for build base: jdk11 is not a value of variable jdk. Valid values: [jdk7 jdk8]"},
+			},
+		},
+	} {
+		got, err := dockergen.ValidateConfigWithOverrides(cfgPath, tc.profile, tc.overrides)
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.want, got, "Case %d: %s", i, tc.name)
+	}
+}
+
+func TestValidateConfigWithIncludes(t *testing.T) {
+	tmpDir, cleanup, err := dirs.TempDir("", "")
+	defer cleanup()
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, "dockergen.yml"), []byte(`include:
+  - other.yml
+builds:
+  app:
+    tag: test/app
+    requires:
+      - base
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, "other.yml"), []byte(`builds:
+  base:
+    tag: test/base:{{.version}}
+    taggs:
+      - test/base
+`), 0644))
+
+	got, err := dockergen.ValidateConfig(path.Join(tmpDir, "dockergen.yml"))
+	require.NoError(t, err)
+	assert.Equal(t, []dockergen.ValidationError{
+		{File: path.Join(tmpDir, "other.yml"), Line: 3, Column: 5, Message: `build base: template for tag: template: env:1:12: executing "env" at <.version>: map has no entry for key "version"`},
+		{File: path.Join(tmpDir, "other.yml"), Line: 4, Column: 5, Message: `unknown key "builds.base.taggs"`},
+	}, got)
+}
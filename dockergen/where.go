@@ -0,0 +1,137 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// validateWhere returns an error if any of the provided patterns is not a valid glob pattern.
+func validateWhere(where map[string][]string) error {
+	for _, k := range sortedForVarNames(where) {
+		for _, pattern := range where[k] {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "invalid 'where' pattern %q for variable %s", pattern, k)
+			}
+		}
+	}
+	return nil
+}
+
+// selectUnits returns the provided units that match the provided filter along with the units whose tags their templates
+// reference (directly or transitively), in their original order. The units that are only selected because the templates
+// of selected units reference their tags are marked as dependencies. The returned units are renumbered to be
+// consecutive. If the filter is empty, all of the units are returned. Returns an error if a variable in the filter is
+// not a variable of any unit, if no unit matches the filter or if the templates of a matching unit cannot be rendered.
+func selectUnits(units []buildUnit, tags *tagStore, where map[string][]string) ([]buildUnit, error) {
+	if len(where) == 0 {
+		return units, nil
+	}
+
+	var unknownVars []string
+	for k := range where {
+		found := false
+		for _, unit := range units {
+			if _, ok := unit.iterVars[k]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknownVars = append(unknownVars, k)
+		}
+	}
+	if len(unknownVars) != 0 {
+		sort.Strings(unknownVars)
+		return nil, errors.Errorf("'where' refers to variables that are not 'for' or 'matrix' variables of any build: %v", unknownVars)
+	}
+
+	selected := make([]bool, len(units))
+	dependency := make([]bool, len(units))
+	var selectDeps func(idx int) error
+	selectDeps = func(idx int) error {
+		referenced, err := referencedUnits(units[idx], tags)
+		if err != nil {
+			return errors.Wrapf(err, "failed to render templates for %s", units[idx].build.Name)
+		}
+		for _, ref := range referenced {
+			if selected[ref] {
+				continue
+			}
+			selected[ref] = true
+			dependency[ref] = true
+			if err := selectDeps(ref); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	matched := false
+	for i, unit := range units {
+		if !unitMatches(unit, where) {
+			continue
+		}
+		matched = true
+		if selected[i] {
+			// already selected as a dependency of an earlier unit, so its dependencies are already selected
+			dependency[i] = false
+			continue
+		}
+		selected[i] = true
+		if err := selectDeps(i); err != nil {
+			return nil, err
+		}
+	}
+	if !matched {
+		return nil, errors.Errorf("no build iterations match 'where' %s", formatWhere(where))
+	}
+
+	var selectedUnits []buildUnit
+	for i, unit := range units {
+		if !selected[i] {
+			continue
+		}
+		unit.idx = len(selectedUnits)
+		unit.dependency = dependency[i]
+		selectedUnits = append(selectedUnits, unit)
+	}
+	return selectedUnits, nil
+}
+
+// unitMatches returns true if, for every variable in the provided filter, the unit has the variable and its value
+// matches any of the patterns for the variable.
+func unitMatches(unit buildUnit, where map[string][]string) bool {
+	for k, patterns := range where {
+		val, ok := unit.iterVars[k]
+		if !ok {
+			return false
+		}
+		matches := false
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, val); ok {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return false
+		}
+	}
+	return true
+}
+
+func formatWhere(where map[string][]string) string {
+	var parts []string
+	for _, k := range sortedForVarNames(where) {
+		for _, pattern := range where[k] {
+			parts = append(parts, k+"="+pattern)
+		}
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
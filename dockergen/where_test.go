@@ -0,0 +1,200 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/nmiyake/dockergen/dockergen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+const whereYML = `
+tag-suffix: -t1
+for:
+  jdk:
+    - jdk7
+    - jdk8
+builds:
+  base:
+    tag: test/base:{{.jdk}}
+  app:
+    tag: test/app:{{.jdk}}-{{.arch}}
+    aliases:
+      - 'test/app:{{.arch}}-on-{{ TagFor "base" "jdk" .jdk }}'
+    requires:
+      - base
+    matrix:
+      arch:
+        - amd64
+        - arm64
+  other:
+    tag: test/other:{{.jdk}}
+`
+
+func TestWhere(t *testing.T) {
+	for i, tc := range []struct {
+		name      string
+		where     map[string][]string
+		want      string
+		wantError string
+	}{
+		{
+			"outer variable selects iterations of all builds",
+			map[string][]string{"jdk": {"jdk8"}},
+			`test/base:jdk8-t1
+test/app:jdk8-amd64-t1
+test/app:amd64-on-test/base:jdk8-t1
+test/app:jdk8-arm64-t1
+test/app:arm64-on-test/base:jdk8-t1
+test/other:jdk8-t1
+`,
+			"",
+		},
+		{
+			"inner variable selects iterations and the iterations whose tags they reference",
+			map[string][]string{"arch": {"arm*"}, "jdk": {"jdk7"}},
+			`test/base:jdk7-t1
+test/app:jdk7-arm64-t1
+test/app:arm64-on-test/base:jdk7-t1
+`,
+			"",
+		},
+		{
+			"any pattern of a variable matches",
+			map[string][]string{"jdk": {"jdk7", "jdk9"}, "arch": {"amd64"}},
+			`test/base:jdk7-t1
+test/app:jdk7-amd64-t1
+test/app:amd64-on-test/base:jdk7-t1
+`,
+			"",
+		},
+		{
+			"variable that is not defined is an error",
+			map[string][]string{"distro": {"alpine"}},
+			"",
+			"'where' refers to variables that are not 'for' or 'matrix' variables of any build: [distro]",
+		},
+		{
+			"filter that matches no iterations is an error",
+			map[string][]string{"jdk": {"jdk11"}},
+			"",
+			"no build iterations match 'where' {jdk=jdk11}",
+		},
+		{
+			"invalid pattern is an error",
+			map[string][]string{"jdk": {"jdk["}},
+			"",
+			`invalid Docker generator params: invalid 'where' pattern "jdk[" for variable jdk: syntax error in pattern`,
+		},
+	} {
+		var cfg dockergen.Config
+		require.NoError(t, yaml.Unmarshal([]byte(whereYML), &cfg), "Case %d: %s", i, tc.name)
+		bParams, err := cfg.BuildParams()
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+
+		params := cfg.ToParams()
+		params.Where = tc.where
+		buf := &bytes.Buffer{}
+		err = dockergen.Tags(nil, bParams, params, buf)
+		if tc.wantError != "" {
+			require.Error(t, err, fmt.Sprintf("Case %d: %s", i, tc.name))
+			assert.EqualError(t, err, tc.wantError, "Case %d: %s", i, tc.name)
+			continue
+		}
+		require.NoError(t, err, "Case %d: %s", i, tc.name)
+		assert.Equal(t, tc.want, buf.String(), "Case %d: %s", i, tc.name)
+	}
+}
+
+func TestWhereDependencyExecutor(t *testing.T) {
+	var cfg dockergen.Config
+	require.NoError(t, yaml.Unmarshal([]byte(whereYML), &cfg))
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	var pushed, dependencies []string
+	recordPush := func(tags *[]string) dockergen.Executor {
+		return funcExecutor(func(w io.Writer, name string, args ...string) error {
+			if len(args) == 2 && args[0] == "push" {
+				*tags = append(*tags, args[1])
+			}
+			return nil
+		})
+	}
+	executor := recordPush(&pushed)
+	params := cfg.ToParams()
+	params.Where = map[string][]string{"jdk": {"jdk8"}, "arch": {"amd64"}}
+	params.DependencyExecutor = recordPush(&dependencies)
+	err = dockergen.Push(map[string]dockergen.Executor{"base": executor, "app": executor, "other": executor}, bParams, params, ioutil.Discard)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"test/app:jdk8-amd64-t1", "test/app:amd64-on-test/base:jdk8-t1"}, pushed)
+	assert.Equal(t, []string{"test/base:jdk8-t1"}, dependencies)
+}
+
+func TestWhereParallel(t *testing.T) {
+	var cfg dockergen.Config
+	require.NoError(t, yaml.Unmarshal([]byte(`
+for:
+  v:
+    - "1"
+    - "2"
+    - "3"
+builds:
+  base:
+    tag: test/base:{{.v}}
+  child:
+    tag: test/child:{{.v}}
+    requires:
+      - base
+    build-args:
+      PREVIOUS: '{{Tag "base" 1 0}}'
+`), &cfg))
+	bParams, err := cfg.BuildParams()
+	require.NoError(t, err)
+
+	recorder := &recordingExecutor{}
+	release := make(chan struct{})
+	// the push of the base that is only selected because the child references its tag does not end until it is released,
+	// so the child is recorded as starting before it ends if the child does not depend on it
+	executor := funcExecutor(func(w io.Writer, name string, args ...string) error {
+		recorder.record("start " + args[1])
+		if args[1] == "test/base:2-unspecified" {
+			<-release
+		}
+		recorder.record("end " + args[1])
+		return nil
+	})
+	params := cfg.ToParams()
+	params.Where = map[string][]string{"v": {"3"}}
+	params.Parallelism = 3
+	done := make(chan error)
+	go func() {
+		done <- dockergen.Push(map[string]dockergen.Executor{"base": executor, "child": executor}, dockergen.TopologicalSort(bParams), params, ioutil.Discard)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	require.NoError(t, <-done)
+
+	for _, before := range [][2]string{
+		{"test/base:2-unspecified", "test/child:3-unspecified"},
+		{"test/base:3-unspecified", "test/child:3-unspecified"},
+	} {
+		endIdx := recorder.indexOf("end " + before[0])
+		startIdx := recorder.indexOf("start " + before[1])
+		require.NotEqual(t, -1, endIdx)
+		require.NotEqual(t, -1, startIdx)
+		assert.True(t, endIdx < startIdx, "%s was not pushed before %s: %v", before[0], before[1], recorder.events)
+	}
+	assert.Equal(t, 6, len(recorder.events), "%v", recorder.events)
+}
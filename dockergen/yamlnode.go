@@ -0,0 +1,245 @@
+// Copyright 2017 Nick Miyake. All rights reserved.
+// Licensed under the MIT License. See LICENSE in the project root
+// for license information.
+
+package dockergen
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// yamlPos is a position in a YAML document. Lines and columns start at 1. The zero value is an unknown position.
+type yamlPos struct {
+	line   int
+	column int
+}
+
+func nodePos(node *yaml.Node) yamlPos {
+	return yamlPos{
+		line:   node.Line,
+		column: node.Column,
+	}
+}
+
+// yamlKeyPositions maps the path of every key and list item in a YAML document to the position at which it appears. A
+// path is the keys from the root of the document to the key joined by ".", where elements of lists are identified by
+// their index in square brackets (for example, "builds.foo.matrix.include[0].jdk").
+type yamlKeyPositions map[string]yamlPos
+
+// nodeKeyPositions returns the positions of the keys and list items in the YAML document with the provided root node.
+// The contents of aliases are not visited, so the keys within them are located at the alias.
+func nodeKeyPositions(root *yaml.Node) yamlKeyPositions {
+	positions := make(yamlKeyPositions)
+	var visit func(node *yaml.Node, path string)
+	visit = func(node *yaml.Node, path string) {
+		switch node.Kind {
+		case yaml.DocumentNode:
+			for _, child := range node.Content {
+				visit(child, path)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				keyPath := joinKeyPath(path, node.Content[i].Value)
+				if _, ok := positions[keyPath]; !ok {
+					positions[keyPath] = nodePos(node.Content[i])
+				}
+				visit(node.Content[i+1], keyPath)
+			}
+		case yaml.SequenceNode:
+			for i, item := range node.Content {
+				itemPath := fmt.Sprintf("%s[%d]", path, i)
+				positions[itemPath] = nodePos(item)
+				visit(item, itemPath)
+			}
+		}
+	}
+	visit(root, "")
+	return positions
+}
+
+// unknownFieldRegexp matches the problems that a decoder that only accepts known fields reports for keys that do not
+// correspond to a field.
+var unknownFieldRegexp = regexp.MustCompile(`^field (.*) not found in type \S+$`)
+
+// unknownKey returns the path and the key and value nodes of the key that the provided problem, which was reported when
+// decoding the document with the provided root node, reports as unknown. Returns nil nodes if the problem is not an
+// unknown key.
+func unknownKey(root *yaml.Node, verr ValidationError) (string, *yaml.Node, *yaml.Node) {
+	match := unknownFieldRegexp.FindStringSubmatch(verr.Message)
+	if match == nil {
+		return "", nil, nil
+	}
+	var keyPath string
+	var keyNode, valueNode *yaml.Node
+	var visit func(node *yaml.Node, path string)
+	visit = func(node *yaml.Node, path string) {
+		switch node.Kind {
+		case yaml.DocumentNode:
+			for _, child := range node.Content {
+				visit(child, path)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content) && keyNode == nil; i += 2 {
+				key := node.Content[i]
+				if key.Line == verr.Line && key.Value == match[1] {
+					keyPath, keyNode, valueNode = joinKeyPath(path, key.Value), key, node.Content[i+1]
+					return
+				}
+				visit(node.Content[i+1], joinKeyPath(path, key.Value))
+			}
+		case yaml.SequenceNode:
+			for i, item := range node.Content {
+				visit(item, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	}
+	visit(root, "")
+	return keyPath, keyNode, valueNode
+}
+
+func joinKeyPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// pos returns the position of the key with the provided path. If the key does not have a known position, the position
+// of the closest ancestor that does is returned. Returns the zero value if no ancestor has a known position.
+func (p yamlKeyPositions) pos(path string) yamlPos {
+	for path != "" {
+		if pos, ok := p[path]; ok {
+			return pos
+		}
+		idx := strings.LastIndexAny(path, ".[")
+		if idx < 0 {
+			break
+		}
+		path = path[:idx]
+	}
+	return yamlPos{}
+}
+
+// yamlErrors returns the problems described by an error returned when parsing or decoding a YAML document into the
+// provided root node (which is nil if the document could not be parsed). The decoder only reports the line of the node
+// that could not be decoded, so the column is that of the first value on the line (or of the first key if the line does
+// not contain a value). Syntax errors are reported without a column.
+func yamlErrors(err error, root *yaml.Node) []ValidationError {
+	var msgs []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		msgs = typeErr.Errors
+	} else {
+		msgs = []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+
+	var verrs []ValidationError
+	for _, msg := range msgs {
+		verr := ValidationError{
+			Message: msg,
+		}
+		var line int
+		if _, err := fmt.Sscanf(msg, "line %d:", &line); err == nil {
+			verr.Line = line
+			verr.Message = strings.TrimSpace(msg[strings.Index(msg, ":")+1:])
+			if root != nil {
+				verr.Column = lineColumn(root, line)
+			}
+		}
+		verrs = append(verrs, verr)
+	}
+	return verrs
+}
+
+// lineColumn returns the column of the first value on the provided line of the document with the provided root node.
+// Block mappings and lists start at their first key or item, so they are not considered to be values. If the line does
+// not contain a value, the column of the first key on the line is returned. Returns 0 if no node starts on the line.
+func lineColumn(root *yaml.Node, line int) int {
+	var valueColumn, keyColumn int
+	var visit func(node *yaml.Node, isKey bool)
+	visit = func(node *yaml.Node, isKey bool) {
+		isBlock := (node.Kind == yaml.MappingNode || node.Kind == yaml.SequenceNode) && node.Style&yaml.FlowStyle == 0
+		if node.Line == line && node.Kind != yaml.DocumentNode && !isBlock {
+			if isKey && keyColumn == 0 {
+				keyColumn = node.Column
+			} else if !isKey && valueColumn == 0 {
+				valueColumn = node.Column
+			}
+		}
+		for i, child := range node.Content {
+			visit(child, node.Kind == yaml.MappingNode && i%2 == 0)
+		}
+	}
+	visit(root, false)
+	if valueColumn != 0 {
+		return valueColumn
+	}
+	return keyColumn
+}
+
+// mapKeys returns the keys of the YAML map that is decoded by the provided function, which is the function passed to an
+// UnmarshalYAML method, in the order in which they appear. yaml.v2 decodes a map into a MapSlice, which preserves the
+// order of its keys, while yaml.v3 cannot decode a map into a MapSlice but passes its node to the UnmarshalYAML method
+// of a nodeMapKeys. The keys of the maps merged into the map are included and every key is only returned once.
+func mapKeys(unmarshal func(interface{}) error) ([]string, error) {
+	var keys []string
+	var mapSlice yamlv2.MapSlice
+	if sliceErr := unmarshal(&mapSlice); sliceErr == nil {
+		for _, item := range mapSlice {
+			keys = append(keys, fmt.Sprint(item.Key))
+		}
+	} else {
+		var nodeKeys nodeMapKeys
+		if err := unmarshal(&nodeKeys); err != nil {
+			return nil, sliceErr
+		}
+		keys = nodeKeys
+	}
+
+	var uniqueKeys []string
+	seen := make(map[string]struct{})
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		uniqueKeys = append(uniqueKeys, key)
+	}
+	return uniqueKeys, nil
+}
+
+// nodeMapKeys are the keys of a YAML map decoded by yaml.v3.
+type nodeMapKeys []string
+
+// UnmarshalYAML records the keys of the map with the provided node followed by the keys of the maps merged into it.
+func (k *nodeMapKeys) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.AliasNode {
+		return k.UnmarshalYAML(node.Alias)
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	var merged []*yaml.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Tag != "!!merge" {
+			*k = append(*k, key.Value)
+			continue
+		}
+		if value.Kind == yaml.SequenceNode {
+			merged = append(merged, value.Content...)
+		} else {
+			merged = append(merged, value)
+		}
+	}
+	for _, mergedNode := range merged {
+		if err := k.UnmarshalYAML(mergedNode); err != nil {
+			return err
+		}
+	}
+	return nil
+}